@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"fulfillmentd/redeemservice/alert"
+	"fulfillmentd/redeemservice/db"
+	"fulfillmentd/server"
+	"github.com/eluv-io/errors-go"
+	"io"
+	"os"
+	"strings"
+)
+
+// runImport imports a CSV or JSONL file of codes, or stdin with "-", into the pool of an offer, straight into the
+// database, then re-arms the low-inventory alerts of the offer as a load through the API does:
+//
+//	import --contract <contract_addr> --offer <redeemable_id> [--url <url>] [--format csv|jsonl] <file>
+func runImport(configFile string, args []string) (err error) {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	contract := flags.String("contract", "", "the contract address of the redeemable offer")
+	offer := flags.String("offer", "", "the redeemable offer id")
+	url := flags.String("url", "", "the url of rows without one")
+	format := flags.String("format", "", "csv or jsonl; by default from the file extension")
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+	if flags.NArg() != 1 {
+		return errors.E("import", errors.K.Invalid, "reason", "expected one file", "args", flags.Args())
+	}
+	file := flags.Arg(0)
+	if *format == "" {
+		*format = db.ImportFormatOf(file)
+	}
+
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		return
+	}
+
+	var s *server.Server
+	if s, err = server.ConnectDb(cfg); err != nil {
+		return
+	}
+	if s.ConnectionManager == nil {
+		return errors.E("import", errors.K.Invalid, "reason", "no database to import into", "store", cfg.DbConfig.Store)
+	}
+	defer s.ConnectionManager.Close()
+
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		var f *os.File
+		if f, err = os.Open(file); err != nil {
+			return
+		}
+		defer f.Close()
+		r = f
+	}
+
+	fp := db.NewFulfillmentPersistence(db.NewPgStore(s.ConnectionManager), nil, nil, nil)
+	summary, err := fp.ImportCodes(*contract, *offer, *url, *format, r)
+
+	out, _ := json.MarshalIndent(summary, "", "  ")
+	fmt.Println(string(out))
+
+	if summary.Inserted > 0 && cfg.Alerts.WebhookUrl != "" {
+		a, alertErr := alert.NewAlerter(cfg.Alerts, fp)
+		if alertErr != nil {
+			if err == nil {
+				err = alertErr
+			}
+			return
+		}
+		a.Restocked(strings.ToLower(*contract), *offer)
+		a.Close()
+	}
+	return
+}
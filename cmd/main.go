@@ -1,22 +1,23 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"fulfillmentd/constants"
 	"fulfillmentd/fulfillmentd"
 	"fulfillmentd/server"
 	"fulfillmentd/server/config"
+	"fulfillmentd/utils"
 	"github.com/eluv-io/errors-go"
 	elog "github.com/eluv-io/log-go"
 	"github.com/eluv-io/log-go/handlers/console"
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/viper"
 	"gopkg.in/natefinch/lumberjack.v2"
-	"io/ioutil"
-	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 type ConfigState struct {
@@ -26,6 +27,15 @@ type ConfigState struct {
 	Verbosity  string
 }
 
+// exit status codes
+const (
+	exitError           = 1 // failed to start, or a listener failed
+	exitShutdownTimeout = 2 // requests were still in flight at the shutdown deadline
+)
+
+// defaultBlockTime is the expected time between blocks unless elv.settings.<network>.block_time_ms is set
+const defaultBlockTime = 5 * time.Second
+
 var (
 	cfgState = ConfigState{}
 	log      = elog.Get("/fs")
@@ -33,13 +43,40 @@ var (
 
 func main() {
 	if len(os.Args) < 3 {
-		fmt.Printf("Usage: %s --config <config.toml>\n", constants.DaemonName)
+		fmt.Printf("Usage: %s --config <config.toml> [migrate up|down|status]\n", constants.DaemonName)
+		fmt.Printf("       %s --config <config.toml> import --contract <addr> --offer <id> [--url <url>] "+
+			"[--format csv|jsonl] <file>\n", constants.DaemonName)
+		return
+	}
+
+	if len(os.Args) > 3 && os.Args[3] == "import" {
+		if err := runImport(os.Args[2], os.Args[4:]); err != nil {
+			fmt.Println("cannot import", "Error", err)
+			os.Exit(exitError)
+		}
+		return
+	}
+
+	if len(os.Args) > 3 && os.Args[3] == "migrate" {
+		if err := runMigrate(os.Args[2], os.Args[4:]); err != nil {
+			fmt.Println("cannot migrate", "Error", err)
+			os.Exit(exitError)
+		}
 		return
 	}
 
-	if _, err := startServer(os.Args[2]); err != nil {
+	s, err := startServer(os.Args[2])
+	if err != nil {
 		fmt.Println("cannot launch", "Error", err)
-		os.Exit(1)
+		os.Exit(exitError)
+	}
+
+	if err = fulfillmentd.Run(s); err != nil {
+		fmt.Println("exiting", "Error", err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			os.Exit(exitShutdownTimeout)
+		}
+		os.Exit(exitError)
 	}
 }
 
@@ -54,6 +91,13 @@ func startServer(configFile string) (s *server.Server, err error) {
 		return
 	}
 
+	err = s.MigrateDb()
+	if err != nil {
+		return
+	}
+
+	s.ConnectEth()
+
 	err = fulfillmentd.Init(s)
 	if err != nil {
 		return
@@ -65,9 +109,22 @@ func startServer(configFile string) (s *server.Server, err error) {
 func loadConfig(configFile string) (cfg *config.AuthorityConfig, err error) {
 	log.Debug("config", "file", configFile)
 	viper.SetDefault(constants.DaemonName+".service_port", 2023)
+	viper.SetDefault(constants.DaemonName+".admin_port", 2024)
+	viper.SetDefault(constants.DaemonName+".admin_bind", "127.0.0.1")
+	viper.SetDefault(constants.DaemonName+".shutdown_timeout_ms", 20000)
 	viper.SetDefault(constants.DaemonName+".log_file", constants.DaemonName)
 	viper.SetDefault(constants.DaemonName+".log_handler", "console")
 	viper.SetDefault(constants.DaemonName+".verbosity", 3)
+	viper.SetDefault("db.store", config.StoreCockroach)
+	viper.SetDefault("eth.call_timeout_ms", 10000)
+	viper.SetDefault("eth.health_check_interval_ms", 30000)
+	viper.SetDefault("eth.ejection_backoff_ms", 5000)
+	viper.SetDefault("eth.max_ejection_backoff_ms", 300000)
+	viper.SetDefault("eth.resolve_retry_ms", 10000)
+	viper.SetDefault("eth.refresh_interval_ms", 600000)
+	viper.SetDefault("alerts.timeout_ms", 5000)
+	viper.SetDefault("alerts.max_attempts", 5)
+	viper.SetDefault("alerts.retry_backoff_ms", 1000)
 	viper.SetDefault(constants.ElvSection+".networks", map[string]string{
 		constants.Main:   "https://main.net955305.contentfabric.io/config",
 		constants.Demov3: "https://demov3.net955210.contentfabric.io/config",
@@ -99,7 +156,7 @@ func loadConfig(configFile string) (cfg *config.AuthorityConfig, err error) {
 		lh.WithTimestamps(true)
 	}
 
-	log.Debug("loadConfig", "service_port", cfg.Port)
+	log.Debug("loadConfig", "service_port", cfg.Port, "admin_port", cfg.AdminPort, "admin_bind", cfg.AdminBind)
 
 	return cfg, nil
 }
@@ -115,21 +172,76 @@ func getBaseConfig(cfg *config.AuthorityConfig) (err error) {
 		return
 	}
 
+	cfg.AdminConfig = getAdminConfig()
+
 	nets := viper.GetStringMapString("elv.networks")
 	log.Info("network configs", "nets", nets)
 
-	cfg.EthUrlsByNetwork = make(map[string]string)
+	cfg.EthConfig = config.EthConfig{
+		CallTimeout:          time.Duration(viper.GetInt("eth.call_timeout_ms")) * time.Millisecond,
+		HealthCheckInterval:  time.Duration(viper.GetInt("eth.health_check_interval_ms")) * time.Millisecond,
+		EjectionBackoff:      time.Duration(viper.GetInt("eth.ejection_backoff_ms")) * time.Millisecond,
+		MaxEjectionBackoff:   time.Duration(viper.GetInt("eth.max_ejection_backoff_ms")) * time.Millisecond,
+		ResolveRetryInterval: time.Duration(viper.GetInt("eth.resolve_retry_ms")) * time.Millisecond,
+		RefreshInterval:      time.Duration(viper.GetInt("eth.refresh_interval_ms")) * time.Millisecond,
+	}
+
+	// a network needs a config url, or eth_urls in its settings
+	cfg.Networks = make(map[string]config.NetworkConfig)
 	for net, url := range nets {
-		var ethUrl string
-		ethUrl, err = getEthUrlFromConfigUrl(url)
-		if err != nil {
-			return
+		cfg.Networks[net] = getNetworkConfig(net, url)
+	}
+	for net := range viper.GetStringMap(constants.ElvSection + ".settings") {
+		if _, ok := cfg.Networks[net]; ok {
+			continue
+		}
+		if netCfg := getNetworkConfig(net, ""); len(netCfg.EthUrls) > 0 {
+			cfg.Networks[net] = netCfg
+		} else {
+			log.Warn("ignoring settings of network without config url or eth_urls", "network", net)
+		}
+	}
+	log.Info("network settings", "networks", cfg.Networks)
+
+	cfg.Policy = config.PolicyConfig{
+		VerifyOwnership: normalizeOffers(viper.GetStringSlice("policy.verify_ownership")),
+	}
+
+	cfg.Simulation = config.SimulationConfig{
+		Enabled:  viper.GetBool("simulation.enabled"),
+		Fixtures: viper.GetString("simulation.fixtures"),
+	}
+	if cfg.Simulation.Enabled && cfg.Simulation.Fixtures == "" {
+		err = errors.E("simulation.fixtures is required in simulation mode")
+		return
+	}
+
+	cfg.Alerts = config.AlertConfig{
+		WebhookUrl:    viper.GetString("alerts.webhook_url"),
+		WebhookSecret: viper.GetString("alerts.webhook_secret"),
+		Timeout:       time.Duration(viper.GetInt("alerts.timeout_ms")) * time.Millisecond,
+		MaxAttempts:   viper.GetInt("alerts.max_attempts"),
+		RetryBackoff:  time.Duration(viper.GetInt("alerts.retry_backoff_ms")) * time.Millisecond,
+		Thresholds:    make(map[string][]string),
+	}
+	for offer, thresholds := range viper.GetStringMapStringSlice("alerts.thresholds") {
+		for _, normalized := range normalizeOffers([]string{offer}) {
+			cfg.Alerts.Thresholds[normalized] = thresholds
 		}
-		cfg.EthUrlsByNetwork[net] = ethUrl
 	}
-	log.Info("eth endpoints", "url-map", cfg.EthUrlsByNetwork)
+	if cfg.Alerts.WebhookUrl != "" && cfg.Alerts.WebhookSecret == "" {
+		err = errors.E("alerts.webhook_secret is required with alerts.webhook_url")
+		return
+	}
 
 	cfg.Port = viper.GetInt(constants.DaemonName + ".service_port")
+	cfg.AdminPort = viper.GetInt(constants.DaemonName + ".admin_port")
+	cfg.AdminBind = viper.GetString(constants.DaemonName + ".admin_bind")
+	cfg.ShutdownTimeout = time.Duration(viper.GetInt(constants.DaemonName+".shutdown_timeout_ms")) * time.Millisecond
+	if cfg.AdminPort == cfg.Port {
+		err = errors.E("admin_port must differ from service_port", "port", cfg.Port)
+		return
+	}
 
 	return
 }
@@ -155,6 +267,7 @@ func loadConfigState(configState *ConfigState, prefix string) error {
 
 func getDbConfig() (dbCfg config.DbConfig, err error) {
 	dbCfg = config.DbConfig{
+		Store:         viper.GetString("db.store"),
 		Username:      viper.GetString("db.username"),
 		Password:      viper.GetString("db.password"),
 		Host:          viper.GetString("db.host"),
@@ -166,6 +279,16 @@ func getDbConfig() (dbCfg config.DbConfig, err error) {
 		SSLMode:       viper.GetString("db.ssl_mode"),
 	}
 
+	switch dbCfg.Store {
+	case config.StoreCockroach:
+	case config.StoreMemory:
+		log.Warn("using in-memory storage; nothing is persisted")
+		return
+	default:
+		err = errors.E("invalid store for database", "store", dbCfg.Store)
+		return
+	}
+
 	switch dbCfg.SSLMode {
 	case "", "disable":
 		log.Warn("disabling TLS for database")
@@ -181,41 +304,60 @@ func getDbConfig() (dbCfg config.DbConfig, err error) {
 	return
 }
 
-// getEthUrlFromConfigUrl loads the fabric config url js data and then pulls out the first eth endpoint in it.
-func getEthUrlFromConfigUrl(configUrl string) (ethUrl string, err error) {
-	var resp *http.Response
-	var body []byte
-	var js map[string]interface{}
-
-	if resp, err = http.Get(configUrl); err != nil {
-		return
+func getNetworkConfig(net, configUrl string) config.NetworkConfig {
+	prefix := constants.ElvSection + ".settings." + net
+	netCfg := config.NetworkConfig{
+		ConfigUrl:        configUrl,
+		EthUrls:          viper.GetStringSlice(prefix + ".eth_urls"),
+		RedeemContracts:  normalizeAddresses(viper.GetStringSlice(prefix + ".redeem_contracts")),
+		MinConfirmations: viper.GetUint64(prefix + ".min_confirmations"),
+		BlockTime:        time.Duration(viper.GetInt(prefix+".block_time_ms")) * time.Millisecond,
 	}
-	defer resp.Body.Close()
-
-	if body, err = ioutil.ReadAll(resp.Body); err != nil {
-		return
+	if netCfg.MinConfirmations == 0 {
+		netCfg.MinConfirmations = 1
 	}
-
-	if err = json.Unmarshal(body, &js); err != nil {
-		return
+	if netCfg.BlockTime <= 0 {
+		netCfg.BlockTime = defaultBlockTime
 	}
+	return netCfg
+}
 
-	if js["network"] == nil {
-		err = errors.NoTrace("no network in config")
-		return
+func getAdminConfig() (adminCfg config.AdminConfig) {
+	adminCfg = config.AdminConfig{
+		Addresses:          normalizeAddresses(viper.GetStringSlice("admin.addresses")),
+		ContractAddresses:  make(map[string][]string),
+		AllowContractOwner: viper.GetBool("admin.allow_contract_owner"),
 	}
-
-	if js["network"].(map[string]interface{})["services"] == nil {
-		err = errors.NoTrace("no services in config")
-		return
+	for contract, addrs := range viper.GetStringMapStringSlice("admin.contracts") {
+		adminCfg.ContractAddresses[strings.ToLower(contract)] = normalizeAddresses(addrs)
 	}
+	log.Info("admin config", "admin", adminCfg)
 
-	if js["network"].(map[string]interface{})["services"].(map[string]interface{})["ethereum_api"] == nil {
-		err = errors.NoTrace("no ethereum_api in config")
-		return
-	}
+	return
+}
 
-	ethUrl = js["network"].(map[string]interface{})["services"].(map[string]interface{})["ethereum_api"].([]interface{})[0].(string)
+// normalizeOffers normalizes the contract address of offers given as "<contract>/<offer id>" or "<contract>/*".
+func normalizeOffers(offers []string) []string {
+	normalized := make([]string, 0, len(offers))
+	for _, offer := range offers {
+		parts := strings.Split(offer, "/")
+		if len(parts) != 2 || utils.NormalizeAddress(parts[0]) == "" || parts[1] == "" {
+			log.Warn("ignoring invalid offer", "offer", offer)
+			continue
+		}
+		normalized = append(normalized, utils.NormalizeAddress(parts[0])+"/"+parts[1])
+	}
+	return normalized
+}
 
-	return
+func normalizeAddresses(addrs []string) []string {
+	normalized := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if a := utils.NormalizeAddress(addr); a != "" {
+			normalized = append(normalized, a)
+		} else {
+			log.Warn("ignoring invalid address", "addr", addr)
+		}
+	}
+	return normalized
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"fulfillmentd/redeemservice/db"
+	"fulfillmentd/server"
+	"github.com/eluv-io/errors-go"
+)
+
+// runMigrate runs the `migrate up|down|status` subcommand against the configured database.
+func runMigrate(configFile string, args []string) (err error) {
+	if len(args) != 1 {
+		return errors.E("migrate", errors.K.Invalid, "reason", "expected one of up, down, status", "args", args)
+	}
+
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		return
+	}
+
+	var s *server.Server
+	if s, err = server.ConnectDb(cfg); err != nil {
+		return
+	}
+	if s.ConnectionManager == nil {
+		return errors.E("migrate", errors.K.Invalid, "reason", "no database to migrate", "store", cfg.DbConfig.Store)
+	}
+	defer s.ConnectionManager.Close()
+
+	var m *db.Migrator
+	if m, err = db.NewMigrator(s.ConnectionManager); err != nil {
+		return
+	}
+
+	var result interface{}
+	switch args[0] {
+	case "up":
+		result, err = m.Up()
+	case "down":
+		result, err = m.Down()
+	case "status":
+		result, err = m.Status()
+	default:
+		err = errors.E("migrate", errors.K.Invalid, "reason", "unknown migrate command", "command", args[0])
+	}
+	if err != nil {
+		return
+	}
+
+	out, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(out))
+	return
+}
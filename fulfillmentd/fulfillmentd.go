@@ -1,7 +1,7 @@
 package fulfillmentd
 
 import (
-	"fmt"
+	"context"
 	"fulfillmentd/constants"
 	api "fulfillmentd/redeemservice"
 	"fulfillmentd/server"
@@ -10,27 +10,62 @@ import (
 	elog "github.com/eluv-io/log-go"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 var log = elog.Get("/fs")
 
-func Init(s *server.Server) error {
+func Init(s *server.Server) (err error) {
 	s.Router = gin.Default()
 	s.Router.Use(defaultCORS)
+	s.AdminRouter = gin.Default()
 
-	s.FulfillmentService = server.NewFulfillmentService(s)
+	if s.FulfillmentService, err = server.NewFulfillmentService(s); err != nil {
+		return
+	}
 	log.Info("Init", "service", s.FulfillmentService)
 
 	addBaseRoutes(s.Router)
+	addBaseRoutes(s.AdminRouter)
 	api.AddRoutes(s)
+	api.AddAdminRoutes(s)
 	log.Info("registered routes")
 
-	err := s.Router.Run(fmt.Sprintf(":%d", s.Cfg.Port))
-	if err != nil {
-		return errors.E("error in service Run()", errors.K.Cancelled, "err", err)
+	return nil
+}
+
+// Run serves the public and admin APIs until SIGINT or SIGTERM, or until a listener fails. On a signal it stops
+// accepting requests and drains in-flight ones for up to fulfillmentd.shutdown_timeout_ms before closing connections.
+// It returns an error wrapping context.DeadlineExceeded if requests were cut off at the deadline.
+func Run(s *server.Server) (err error) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	errs := s.Serve()
+
+	select {
+	case sig := <-sigs:
+		log.Info("shutting down", "signal", sig, "timeout", s.Cfg.ShutdownTimeout)
+	case err = <-errs:
+		log.Error("listener failed; shutting down", "err", err)
+		err = errors.E("error in service Run()", errors.K.Cancelled, err)
 	}
 
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), s.Cfg.ShutdownTimeout)
+	defer cancel()
+	if shutdownErr := s.Shutdown(ctx); shutdownErr != nil {
+		log.Error("shutdown incomplete", "err", shutdownErr)
+		if err == nil {
+			err = errors.E("shutdown incomplete", errors.K.Cancelled, shutdownErr)
+		}
+		return
+	}
+	log.Info("shutdown complete")
+
+	return
 }
 
 func addBaseRoutes(engine *gin.Engine) {
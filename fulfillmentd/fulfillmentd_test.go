@@ -0,0 +1,1190 @@
+package fulfillmentd_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"fulfillmentd/fulfillmentd"
+	"fulfillmentd/redeemservice/db"
+	"fulfillmentd/redeemservice/fulfiller"
+	"fulfillmentd/server"
+	"fulfillmentd/server/config"
+	"fulfillmentd/server/eth/ethtest"
+	"github.com/eluv-io/common-go/format/eat"
+	"github.com/eluv-io/common-go/format/id"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	network  = "demov3"
+	contract = "0xb914ad493a0a4fe5a899dc21b66a509bcf8f1ed9"
+)
+
+// testEnv is a daemon booted by fulfillmentd.Init with in-memory storage and a fake chain, with offers 0 and 1 of
+// the contract registered.
+type testEnv struct {
+	t     *testing.T
+	s     *server.Server
+	chain *ethtest.FakeChain
+	admin *ecdsa.PrivateKey
+	user  *ecdsa.PrivateKey
+}
+
+type fulfillResponse struct {
+	Message      string `json:"message"`
+	Fulfillments []struct {
+		Status          string `json:"status"`
+		FulfillmentData struct {
+			Url  string `json:"url"`
+			Code string `json:"code"`
+		} `json:"fulfillment_data"`
+		Transaction struct {
+			TokenId int64 `json:"token_id"`
+			OfferId uint8 `json:"offer_id"`
+		} `json:"transaction"`
+	} `json:"fulfillments"`
+}
+
+func newTestEnv(t *testing.T, netCfg config.NetworkConfig, opts ...func(cfg *config.AuthorityConfig)) *testEnv {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter, gin.DefaultErrorWriter = io.Discard, io.Discard
+
+	env := &testEnv{t: t, chain: ethtest.NewFakeChain(network), admin: newKey(t), user: newKey(t)}
+	cfg := &config.AuthorityConfig{
+		DbConfig:    config.DbConfig{Store: config.StoreMemory},
+		AdminConfig: config.AdminConfig{Addresses: []string{address(env.admin)}},
+		Networks:    map[string]config.NetworkConfig{network: netCfg},
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	env.s = &server.Server{Cfg: cfg, Chain: env.chain}
+	if err := fulfillmentd.Init(env.s); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(env.s.Close)
+
+	for _, offerId := range []int{0, 1} {
+		if rec := env.register(offerId, map[string]interface{}{"name": "test"}); rec.Code != http.StatusOK {
+			t.Fatalf("register: %s", rec.Body.String())
+		}
+	}
+
+	return env
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func address(key *ecdsa.PrivateKey) string {
+	return strings.ToLower(crypto.PubkeyToAddress(key.PublicKey).Hex())
+}
+
+func (env *testEnv) token(key *ecdsa.PrivateKey) string {
+	tok, err := eat.NewClientSigned(id.Generate(id.QSpace)).Sign(key).Encode()
+	if err != nil {
+		env.t.Error(err)
+	}
+	return tok
+}
+
+// do serves a request on `router`, with a bearer token signed by `key` unless nil, and decodes the json response
+// into `resp` unless nil.
+func (env *testEnv) do(router http.Handler, method, path string, key *ecdsa.PrivateKey, body interface{},
+	resp interface{}) *httptest.ResponseRecorder {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			env.t.Error(err)
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if key != nil {
+		req.Header.Set("Authorization", "Bearer "+env.token(key))
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if resp != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), resp); err != nil {
+			env.t.Errorf("invalid json response %q: %v", rec.Body.String(), err)
+		}
+	}
+	return rec
+}
+
+func (env *testEnv) load(offerId int, codes ...string) *httptest.ResponseRecorder {
+	path := fmt.Sprintf("/%s/load/%s/%d", network, contract, offerId)
+	body := map[string]interface{}{"url": "https://live.eluv.io/", "codes": codes}
+	return env.do(env.s.AdminRouter, http.MethodPost, path, env.admin, body, nil)
+}
+
+func (env *testEnv) register(offerId int, body interface{}) *httptest.ResponseRecorder {
+	path := fmt.Sprintf("/%s/offers/%s/%d", network, contract, offerId)
+	return env.do(env.s.AdminRouter, http.MethodPut, path, env.admin, body, nil)
+}
+
+func (env *testEnv) fulfill(key *ecdsa.PrivateKey, tx string, resp interface{}) *httptest.ResponseRecorder {
+	return env.do(env.s.Router, http.MethodGet, fmt.Sprintf("/%s/fulfill/%s", network, tx), key, nil, resp)
+}
+
+// redeem adds a transaction redeeming `offerId` of `tokenId` by the user to the chain.
+func (env *testEnv) redeem(tokenId int64, offerIds ...uint8) string {
+	tx := ethtest.Tx{}
+	for _, offerId := range offerIds {
+		tx.Redeems = append(tx.Redeems, ethtest.Redeem{
+			Contract: contract, Redeemer: address(env.user), TokenId: tokenId, OfferId: offerId,
+		})
+	}
+	return env.chain.AddTx(tx)
+}
+
+func TestLoad(t *testing.T) {
+	env := newTestEnv(t, config.NetworkConfig{})
+	path := fmt.Sprintf("/%s/load/%s/0", network, contract)
+	valid := map[string]interface{}{"url": "https://live.eluv.io/", "codes": []string{"ABC123"}}
+
+	tests := []struct {
+		name   string
+		key    *ecdsa.PrivateKey
+		body   interface{}
+		status int
+	}{
+		{"valid", env.admin, valid, http.StatusOK},
+		{"missing url", env.admin, map[string]interface{}{"codes": []string{"ABC123"}}, http.StatusBadRequest},
+		{"missing codes", env.admin, map[string]interface{}{"url": "https://live.eluv.io/"}, http.StatusBadRequest},
+		{"empty codes", env.admin, map[string]interface{}{"url": "https://live.eluv.io/", "codes": []string{}},
+			http.StatusBadRequest},
+		{"invalid body", env.admin, "not an object", http.StatusBadRequest},
+		{"missing auth", nil, valid, http.StatusUnauthorized},
+		{"not an admin", env.user, valid, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp map[string]interface{}
+			rec := env.do(env.s.AdminRouter, http.MethodPost, path, tt.key, tt.body, &resp)
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+
+	t.Run("invalid token", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"url":"u","codes":["c"]}`))
+		req.Header.Set("Authorization", "Bearer not-a-token")
+		rec := httptest.NewRecorder()
+		env.s.AdminRouter.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("status %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body.String())
+		}
+	})
+
+	t.Run("admin routes not public", func(t *testing.T) {
+		rec := env.do(env.s.Router, http.MethodPost, path, env.admin, valid, nil)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("status %d, want %d", rec.Code, http.StatusNotFound)
+		}
+	})
+}
+
+func TestLoadDuplicates(t *testing.T) {
+	env := newTestEnv(t, config.NetworkConfig{})
+	path := fmt.Sprintf("/%s/load/%s/0", network, contract)
+
+	type loadResponse struct {
+		Loaded     int      `json:"loaded"`
+		Duplicates []string `json:"duplicates"`
+	}
+	load := func(key string, codes ...string) (rec *httptest.ResponseRecorder, resp loadResponse) {
+		data, _ := json.Marshal(map[string]interface{}{"url": "https://live.eluv.io/", "codes": codes})
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+env.token(env.admin))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rec = httptest.NewRecorder()
+		env.s.AdminRouter.ServeHTTP(rec, req)
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Errorf("invalid json response %q: %v", rec.Body.String(), err)
+			}
+		}
+		return
+	}
+	unclaimed := func() int {
+		var export struct {
+			Unclaimed []string `json:"unclaimed"`
+		}
+		env.do(env.s.AdminRouter, http.MethodGet, fmt.Sprintf("/%s/export/%s/0", network, contract), env.admin, nil,
+			&export)
+		return len(export.Unclaimed)
+	}
+
+	rec, resp := load("", "ABC123", "XYZ789", "ABC123")
+	if rec.Code != http.StatusOK || resp.Loaded != 2 || len(resp.Duplicates) != 1 || resp.Duplicates[0] != "ABC123" {
+		t.Fatalf("load: status %d, %s", rec.Code, rec.Body.String())
+	}
+
+	t.Run("reload", func(t *testing.T) {
+		rec, resp := load("", "ABC123", "XYZ789", "NEW001")
+		if rec.Code != http.StatusOK || resp.Loaded != 1 || len(resp.Duplicates) != 2 {
+			t.Errorf("status %d, %s", rec.Code, rec.Body.String())
+		}
+		if n := unclaimed(); n != 3 {
+			t.Errorf("unclaimed %d, want 3", n)
+		}
+	})
+
+	t.Run("idempotency key", func(t *testing.T) {
+		rec, first := load("load-1", "KEY001", "KEY002")
+		if rec.Code != http.StatusOK || first.Loaded != 2 || rec.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatalf("status %d, %s", rec.Code, rec.Body.String())
+		}
+
+		rec, replay := load("load-1", "KEY001", "KEY002")
+		if rec.Code != http.StatusOK || replay.Loaded != 2 || len(replay.Duplicates) != 0 {
+			t.Errorf("replay: status %d, %s", rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("Idempotent-Replayed") != "true" {
+			t.Errorf("replay without the Idempotent-Replayed header")
+		}
+		if n := unclaimed(); n != 5 {
+			t.Errorf("unclaimed %d, want 5", n)
+		}
+
+		if rec, _ = load("load-1", "KEY003"); rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("key reused: status %d, want %d: %s", rec.Code, http.StatusUnprocessableEntity,
+				rec.Body.String())
+		}
+	})
+
+	t.Run("concurrent idempotency key", func(t *testing.T) {
+		var wg sync.WaitGroup
+		var replayed int32
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rec, resp := load("load-2", "CONC01", "CONC02")
+				if rec.Code != http.StatusOK || resp.Loaded != 2 {
+					t.Errorf("status %d, %s", rec.Code, rec.Body.String())
+				}
+				if rec.Header().Get("Idempotent-Replayed") == "true" {
+					atomic.AddInt32(&replayed, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		if replayed != 7 {
+			t.Errorf("%d replays, want 7", replayed)
+		}
+		if n := unclaimed(); n != 7 {
+			t.Errorf("unclaimed %d, want 7", n)
+		}
+	})
+
+	t.Run("export checksum case", func(t *testing.T) {
+		var export struct {
+			Unclaimed []string `json:"unclaimed"`
+		}
+		rec := env.do(env.s.AdminRouter, http.MethodGet,
+			fmt.Sprintf("/%s/export/%s/0", network, "0xB914ad493a0a4fe5a899dc21b66a509bcf8f1ED9"), env.admin, nil, &export)
+		if rec.Code != http.StatusOK || len(export.Unclaimed) != unclaimed() {
+			t.Errorf("export: %d %s, want %d unclaimed", rec.Code, rec.Body.String(), unclaimed())
+		}
+	})
+}
+
+func TestFulfill(t *testing.T) {
+	env := newTestEnv(t, config.NetworkConfig{})
+	if rec := env.load(0, "ABC123", "XYZ789"); rec.Code != http.StatusOK {
+		t.Fatalf("load: %s", rec.Body.String())
+	}
+	tx := env.redeem(34, 0)
+
+	var first fulfillResponse
+	rec := env.fulfill(env.user, tx, &first)
+	if rec.Code != http.StatusOK || len(first.Fulfillments) != 1 || first.Fulfillments[0].Status != "fulfilled" {
+		t.Fatalf("fulfill: %d %s", rec.Code, rec.Body.String())
+	}
+	code := first.Fulfillments[0].FulfillmentData.Code
+	if code != "ABC123" && code != "XYZ789" {
+		t.Errorf("fulfilled code %q not loaded", code)
+	}
+
+	t.Run("already claimed replay", func(t *testing.T) {
+		var replay fulfillResponse
+		rec := env.fulfill(env.user, tx, &replay)
+		if rec.Code != http.StatusOK || replay.Fulfillments[0].Status != "already_fulfilled" {
+			t.Fatalf("replay: %d %s", rec.Code, rec.Body.String())
+		}
+		if replay.Fulfillments[0].FulfillmentData.Code != code {
+			t.Errorf("replayed code %q, want %q", replay.Fulfillments[0].FulfillmentData.Code, code)
+		}
+	})
+
+	t.Run("out of codes", func(t *testing.T) {
+		var resp fulfillResponse
+		if rec := env.fulfill(env.user, env.redeem(35, 0), &resp); rec.Code != http.StatusOK {
+			t.Fatalf("second code: %d %s", rec.Code, rec.Body.String())
+		}
+		rec := env.fulfill(env.user, env.redeem(36, 0), &resp)
+		if rec.Code != http.StatusBadRequest || resp.Fulfillments[0].Status != "failed" {
+			t.Errorf("out of codes: %d %s", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("multiple redemptions", func(t *testing.T) {
+		env.load(1, "OFFER1")
+		env.register(2, map[string]interface{}{})
+		var resp fulfillResponse
+		rec := env.fulfill(env.user, env.redeem(37, 1, 2), &resp)
+		if rec.Code != http.StatusOK || resp.Message != "partially fulfilled redeemable offers" ||
+			len(resp.Fulfillments) != 2 {
+			t.Fatalf("multiple: %d %s", rec.Code, rec.Body.String())
+		}
+		if resp.Fulfillments[0].Status != "fulfilled" || resp.Fulfillments[0].FulfillmentData.Code != "OFFER1" ||
+			resp.Fulfillments[1].Status != "failed" {
+			t.Errorf("multiple: %s", rec.Body.String())
+		}
+	})
+
+	t.Run("checksum case load", func(t *testing.T) {
+		path := fmt.Sprintf("/%s/load/%s/0", network, "0xB914ad493a0a4fe5a899dc21b66a509bcf8f1ED9")
+		body := map[string]interface{}{"url": "https://live.eluv.io/", "codes": []string{"UPPER1"}}
+		if rec := env.do(env.s.AdminRouter, http.MethodPost, path, env.admin, body, nil); rec.Code != http.StatusOK {
+			t.Fatalf("load: %d %s", rec.Code, rec.Body.String())
+		}
+		var resp fulfillResponse
+		rec := env.fulfill(env.user, env.redeem(38, 0), &resp)
+		if rec.Code != http.StatusOK || resp.Fulfillments[0].FulfillmentData.Code != "UPPER1" {
+			t.Errorf("fulfill: %d %s", rec.Code, rec.Body.String())
+		}
+	})
+}
+
+func TestRedeemLogs(t *testing.T) {
+	const other = "0x0000000000000000000000000000000000000002"
+	env := newTestEnv(t, config.NetworkConfig{RedeemContracts: []string{contract}})
+	env.load(0, "ABC123", "XYZ789", "DEF456")
+	env.load(1, "OFFER1")
+	redeem := func(contract string, tokenId int64, offerId uint8) ethtest.Redeem {
+		return ethtest.Redeem{Contract: contract, Redeemer: address(env.user), TokenId: tokenId, OfferId: offerId}
+	}
+	transfer := types.Log{
+		Address: common.HexToAddress(contract),
+		Topics:  []common.Hash{crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))},
+	}
+
+	tests := []struct {
+		name   string
+		tx     ethtest.Tx
+		status int
+		offers []uint8 // fulfilled, in order
+	}{
+		{"other log first", ethtest.Tx{Redeems: []ethtest.Redeem{redeem(contract, 1, 0)},
+			OtherLogs: []types.Log{transfer}}, http.StatusOK, []uint8{0}},
+		{"contract not allowed", ethtest.Tx{Redeems: []ethtest.Redeem{redeem(other, 2, 0), redeem(contract, 2, 0)}},
+			http.StatusOK, []uint8{0}},
+		{"only contracts not allowed", ethtest.Tx{Redeems: []ethtest.Redeem{redeem(other, 3, 0)}},
+			http.StatusBadRequest, nil},
+		{"two redeems", ethtest.Tx{Redeems: []ethtest.Redeem{redeem(contract, 4, 0), redeem(contract, 4, 1)}},
+			http.StatusOK, []uint8{0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp fulfillResponse
+			rec := env.fulfill(env.user, env.chain.AddTx(tt.tx), &resp)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if len(resp.Fulfillments) != len(tt.offers) {
+				t.Fatalf("%d fulfillments, want %d: %s", len(resp.Fulfillments), len(tt.offers), rec.Body.String())
+			}
+			for i, f := range resp.Fulfillments {
+				if f.Status != "fulfilled" || f.Transaction.OfferId != tt.offers[i] {
+					t.Errorf("fulfillment %d: %+v, want offer %d fulfilled", i, f, tt.offers[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFulfillErrors(t *testing.T) {
+	env := newTestEnv(t, config.NetworkConfig{})
+	env.load(0, "ABC123", "XYZ789")
+	other := newKey(t)
+
+	tests := []struct {
+		name   string
+		key    *ecdsa.PrivateKey
+		path   string
+		status int
+	}{
+		{"wrong user", other, "/demov3/fulfill/" + env.redeem(1, 0), http.StatusBadRequest},
+		{"pending tx", env.user, "/demov3/fulfill/" + env.chain.AddTx(ethtest.Tx{Pending: true}), http.StatusBadRequest},
+		{"reverted tx", env.user, "/demov3/fulfill/" + env.chain.AddTx(ethtest.Tx{Reverted: true}),
+			http.StatusBadRequest},
+		{"unknown tx", env.user, "/demov3/fulfill/0x" + strings.Repeat("ab", 32), http.StatusBadRequest},
+		{"invalid tx id", env.user, "/demov3/fulfill/tx-test-0000", http.StatusBadRequest},
+		{"invalid network", env.user, "/invalid/fulfill/" + env.redeem(2, 0), http.StatusBadRequest},
+		{"missing auth", nil, "/demov3/fulfill/" + env.redeem(3, 0), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := env.do(env.s.Router, http.MethodGet, tt.path, tt.key, nil, &map[string]interface{}{})
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+
+	t.Run("invalid auth", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/demov3/fulfill/"+env.redeem(4, 0), nil)
+		req.Header.Set("Authorization", "Bearer not-a-token")
+		rec := httptest.NewRecorder()
+		env.s.Router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("status %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body.String())
+		}
+	})
+
+	t.Run("network down", func(t *testing.T) {
+		tx := env.redeem(5, 0)
+		env.chain.SetDown(network, true)
+		defer env.chain.SetDown(network, false)
+		if rec := env.fulfill(env.user, tx, nil); rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("status %d, want %d: %s", rec.Code, http.StatusServiceUnavailable, rec.Body.String())
+		}
+	})
+}
+
+func TestFulfillNotFinal(t *testing.T) {
+	env := newTestEnv(t, config.NetworkConfig{MinConfirmations: 3, BlockTime: 5000000000})
+	env.load(0, "ABC123")
+	tx := env.redeem(1, 0)
+
+	rec := env.fulfill(env.user, tx, nil)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "10" {
+		t.Fatalf("not final: %d Retry-After %q %s", rec.Code, rec.Header().Get("Retry-After"), rec.Body.String())
+	}
+
+	env.chain.Mine(2)
+	if rec = env.fulfill(env.user, tx, nil); rec.Code != http.StatusOK {
+		t.Errorf("final: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSimulation(t *testing.T) {
+	owner := newKey(t)
+	fixtures := map[string]interface{}{
+		"receipts": []map[string]interface{}{
+			{"transaction": "tx-test-0000", "redemptions": []map[string]interface{}{
+				{"contract_address": contract, "token_id": 1, "offer_id": 0},
+			}},
+			{"transaction": "tx-test-owned", "redemptions": []map[string]interface{}{
+				{"contract_address": contract, "user_address": crypto.PubkeyToAddress(owner.PublicKey).Hex(),
+					"token_id": 2, "offer_id": 0},
+			}},
+		},
+	}
+	data, _ := json.Marshal(fixtures)
+	path := filepath.Join(t.TempDir(), "simulation.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	env := newTestEnv(t, config.NetworkConfig{}, func(cfg *config.AuthorityConfig) {
+		cfg.Simulation = config.SimulationConfig{Enabled: true, Fixtures: path}
+	})
+	env.load(0, "ABC123", "XYZ789", "SIM001")
+
+	t.Run("fixture", func(t *testing.T) {
+		var resp fulfillResponse
+		rec := env.fulfill(env.user, "tx-test-0000", &resp)
+		if rec.Code != http.StatusOK || len(resp.Fulfillments) != 1 || resp.Fulfillments[0].Status != "fulfilled" ||
+			resp.Fulfillments[0].Transaction.TokenId != 1 {
+			t.Fatalf("fulfill: %d %s", rec.Code, rec.Body.String())
+		}
+
+		var replay fulfillResponse
+		if rec := env.fulfill(env.user, "tx-test-0000", &replay); rec.Code != http.StatusOK ||
+			replay.Fulfillments[0].FulfillmentData.Code != resp.Fulfillments[0].FulfillmentData.Code {
+			t.Errorf("replay: %d %s", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("fixture of another user", func(t *testing.T) {
+		var resp fulfillResponse
+		rec := env.fulfill(env.user, "tx-test-owned", &resp)
+		if rec.Code != http.StatusBadRequest || len(resp.Fulfillments) != 1 || resp.Fulfillments[0].Status != "failed" {
+			t.Errorf("status %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body.String())
+		}
+
+		if rec := env.fulfill(owner, "tx-test-owned", &resp); rec.Code != http.StatusOK ||
+			resp.Fulfillments[0].Status != "fulfilled" {
+			t.Errorf("owner: %d %s", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("unknown tx", func(t *testing.T) {
+		for _, tx := range []string{"tx-test-unknown", env.redeem(3, 0)} {
+			if rec := env.fulfill(env.user, tx, nil); rec.Code != http.StatusBadRequest {
+				t.Errorf("%s: status %d, want %d: %s", tx, rec.Code, http.StatusBadRequest, rec.Body.String())
+			}
+		}
+	})
+}
+
+func TestVerifyOwnership(t *testing.T) {
+	env := newTestEnv(t, config.NetworkConfig{}, func(cfg *config.AuthorityConfig) {
+		cfg.Policy.VerifyOwnership = []string{contract + "/0"}
+	})
+	env.load(0, "ABC123", "XYZ789")
+	env.load(1, "OFFER1")
+
+	if rec := env.fulfill(env.user, env.redeem(1, 0), nil); rec.Code != http.StatusOK {
+		t.Errorf("owner: %d %s", rec.Code, rec.Body.String())
+	}
+
+	transferred := env.redeem(2, 0)
+	env.chain.SetTokenOwner(contract, 2, address(newKey(t)))
+	if rec := env.fulfill(env.user, transferred, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("transferred: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// offer 1 is not under the policy
+	if rec := env.fulfill(env.user, env.redeem(3, 1), nil); rec.Code != http.StatusOK {
+		t.Errorf("no policy: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestImport(t *testing.T) {
+	env := newTestEnv(t, config.NetworkConfig{})
+	env.load(0, "LOADED")
+
+	type importResponse struct {
+		Rows           int      `json:"rows"`
+		Inserted       int      `json:"inserted"`
+		Duplicates     int      `json:"duplicates"`
+		Rejected       int      `json:"rejected"`
+		DuplicateCodes []string `json:"duplicate_codes"`
+		RejectedRows   []struct {
+			Line int `json:"line"`
+		} `json:"rejected_rows"`
+	}
+	post := func(query, contentType string, body io.Reader, resp interface{}) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/%s/import/%s/0%s", network, contract, query), body)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Authorization", "Bearer "+env.token(env.admin))
+		rec := httptest.NewRecorder()
+		env.s.AdminRouter.ServeHTTP(rec, req)
+		if resp != nil {
+			if err := json.Unmarshal(rec.Body.Bytes(), resp); err != nil {
+				t.Errorf("invalid json response %q: %v", rec.Body.String(), err)
+			}
+		}
+		return rec
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		csv := "code,url,batch\n" +
+			"CSV1,https://a.eluv.io/,b1\n" +
+			"CSV2,,b1\n" +
+			"CSV1,,b1\n" +
+			"LOADED,,b1\n" +
+			",https://a.eluv.io/,b1\n" +
+			"CSV3,too,many,fields\n"
+		var resp importResponse
+		rec := post("?url=https://live.eluv.io/", "text/csv", strings.NewReader(csv), &resp)
+		if rec.Code != http.StatusOK || resp.Rows != 6 || resp.Inserted != 2 || resp.Duplicates != 2 ||
+			resp.Rejected != 2 {
+			t.Fatalf("csv: %d %s", rec.Code, rec.Body.String())
+		}
+		if len(resp.RejectedRows) != 2 || resp.RejectedRows[0].Line != 6 || resp.RejectedRows[1].Line != 7 {
+			t.Errorf("rejected rows: %+v", resp.RejectedRows)
+		}
+	})
+
+	t.Run("jsonl", func(t *testing.T) {
+		jsonl := `{"code":"JSON1","metadata":{"pin":"1234"}}` + "\n" +
+			"\n" +
+			`{"code":"JSON2","url":"https://b.eluv.io/"}` + "\n" +
+			`{"code":"JSON3","metadata":"not an object"}` + "\n" +
+			`not json` + "\n" +
+			`{"code":"CSV2"}` + "\n"
+		var resp importResponse
+		rec := post("?url=https://live.eluv.io/&format=jsonl", "application/octet-stream", strings.NewReader(jsonl),
+			&resp)
+		if rec.Code != http.StatusOK || resp.Rows != 5 || resp.Inserted != 2 || resp.Duplicates != 1 ||
+			resp.Rejected != 2 || len(resp.DuplicateCodes) != 1 || resp.DuplicateCodes[0] != "CSV2" {
+			t.Errorf("jsonl: %d %s", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("multipart", func(t *testing.T) {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		_ = form.WriteField("note", "ignored")
+		part, _ := form.CreateFormFile("file", "codes.ndjson")
+		_, _ = part.Write([]byte(`{"code":"FORM1","url":"https://c.eluv.io/"}` + "\n"))
+		_ = form.Close()
+
+		var resp importResponse
+		rec := post("", form.FormDataContentType(), &body, &resp)
+		if rec.Code != http.StatusOK || resp.Inserted != 1 {
+			t.Errorf("multipart: %d %s", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		tests := []struct {
+			name        string
+			contentType string
+			body        string
+		}{
+			{"unknown format", "application/octet-stream", "code\nX\n"},
+			{"no code column", "text/csv", "url\nhttps://live.eluv.io/\n"},
+			{"empty csv", "text/csv", ""},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if rec := post("", tt.contentType, strings.NewReader(tt.body), nil); rec.Code != http.StatusBadRequest {
+					t.Errorf("status %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body.String())
+				}
+			})
+		}
+	})
+
+	var export struct {
+		Unclaimed []string `json:"unclaimed"`
+	}
+	env.do(env.s.AdminRouter, http.MethodGet, fmt.Sprintf("/%s/export/%s/0", network, contract), env.admin, nil,
+		&export)
+	if len(export.Unclaimed) != 6 {
+		t.Errorf("unclaimed %v, want 6 codes", export.Unclaimed)
+	}
+
+	var resp fulfillResponse
+	env.fulfill(env.user, env.redeem(1, 0), &resp)
+	if len(resp.Fulfillments) != 1 || resp.Fulfillments[0].Status != "fulfilled" {
+		t.Errorf("fulfill imported: %+v", resp.Fulfillments)
+	}
+}
+
+func TestPayload(t *testing.T) {
+	env := newTestEnv(t, config.NetworkConfig{})
+	payload := `{"pin":"1234","serial":"SN-0001","expires":"2027-01-01"}`
+
+	path := fmt.Sprintf("/%s/load/%s/0", network, contract)
+	body := map[string]interface{}{
+		"entries": []interface{}{
+			map[string]interface{}{"code": "VOUCHER1", "payload": json.RawMessage(payload)},
+		},
+	}
+	var loaded struct {
+		Loaded int `json:"loaded"`
+	}
+	if rec := env.do(env.s.AdminRouter, http.MethodPost, path, env.admin, body, &loaded); rec.Code != http.StatusOK ||
+		loaded.Loaded != 1 {
+		t.Fatalf("load: %d %s", rec.Code, rec.Body.String())
+	}
+
+	var resp struct {
+		Fulfillments []struct {
+			Status          string          `json:"status"`
+			FulfillmentData json.RawMessage `json:"fulfillment_data"`
+		} `json:"fulfillments"`
+	}
+	tx := env.redeem(34, 0)
+	for _, status := range []string{"fulfilled", "already_fulfilled"} {
+		rec := env.fulfill(env.user, tx, &resp)
+		if rec.Code != http.StatusOK || len(resp.Fulfillments) != 1 || resp.Fulfillments[0].Status != status {
+			t.Fatalf("fulfill: %d %s", rec.Code, rec.Body.String())
+		}
+		if string(resp.Fulfillments[0].FulfillmentData) != payload {
+			t.Errorf("%s: fulfillment data %s, want %s", status, resp.Fulfillments[0].FulfillmentData, payload)
+		}
+	}
+
+	t.Run("import", func(t *testing.T) {
+		jsonl := `{"code":"VOUCHER2","payload":{"pin":"5678"}}` + "\n" + `{"code":"PLAIN"}` + "\n"
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/%s/import/%s/1", network, contract),
+			strings.NewReader(jsonl))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Set("Authorization", "Bearer "+env.token(env.admin))
+		rec := httptest.NewRecorder()
+		env.s.AdminRouter.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"inserted":1`) {
+			t.Fatalf("import: %d %s", rec.Code, rec.Body.String())
+		}
+
+		if rec := env.fulfill(env.user, env.redeem(35, 1), &resp); rec.Code != http.StatusOK ||
+			string(resp.Fulfillments[0].FulfillmentData) != `{"pin":"5678"}` {
+			t.Errorf("fulfill: %d %s", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("entry without url or payload", func(t *testing.T) {
+		body := map[string]interface{}{"entries": []interface{}{map[string]interface{}{"code": "NOURL"}}}
+		if rec := env.do(env.s.AdminRouter, http.MethodPost, path, env.admin, body, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("status %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body.String())
+		}
+	})
+}
+
+func TestStats(t *testing.T) {
+	env := newTestEnv(t, config.NetworkConfig{})
+	env.load(0, "CODE0", "CODE1", "CODE2")
+	env.load(1, "OFFER1")
+	if rec := env.fulfill(env.user, env.redeem(34, 0), nil); rec.Code != http.StatusOK {
+		t.Fatalf("fulfill: %d %s", rec.Code, rec.Body.String())
+	}
+
+	type offerStats struct {
+		OfferId    string `json:"offer_id"`
+		Total      int    `json:"total"`
+		Claimed    int    `json:"claimed"`
+		Remaining  int    `json:"remaining"`
+		ClaimRates []struct {
+			Window  string  `json:"window"`
+			Claimed int     `json:"claimed"`
+			PerHour float64 `json:"per_hour"`
+		} `json:"claim_rates"`
+		FirstClaim *time.Time `json:"first_claim"`
+		LastClaim  *time.Time `json:"last_claim"`
+	}
+
+	var offer offerStats
+	rec := env.do(env.s.AdminRouter, http.MethodGet, fmt.Sprintf("/%s/stats/%s/0", network, contract), env.admin, nil,
+		&offer)
+	if rec.Code != http.StatusOK || offer.Total != 3 || offer.Claimed != 1 || offer.Remaining != 2 {
+		t.Fatalf("stats: %d %s", rec.Code, rec.Body.String())
+	}
+	if len(offer.ClaimRates) != 3 || offer.ClaimRates[0].Window != "1h" || offer.ClaimRates[0].Claimed != 1 ||
+		offer.ClaimRates[0].PerHour != 1 || offer.ClaimRates[2].Claimed != 1 {
+		t.Errorf("claim rates: %s", rec.Body.String())
+	}
+	if offer.FirstClaim == nil || offer.LastClaim == nil || !offer.FirstClaim.Equal(*offer.LastClaim) {
+		t.Errorf("claim times: %s", rec.Body.String())
+	}
+
+	t.Run("contract", func(t *testing.T) {
+		var resp struct {
+			Offers []offerStats `json:"offers"`
+		}
+		rec := env.do(env.s.AdminRouter, http.MethodGet, fmt.Sprintf("/%s/stats/%s", network, contract), env.admin,
+			nil, &resp)
+		if rec.Code != http.StatusOK || len(resp.Offers) != 2 || resp.Offers[1].OfferId != "1" ||
+			resp.Offers[1].Remaining != 1 || resp.Offers[1].FirstClaim != nil {
+			t.Errorf("stats: %d %s", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("checksum case", func(t *testing.T) {
+		var resp offerStats
+		rec := env.do(env.s.AdminRouter, http.MethodGet,
+			fmt.Sprintf("/%s/stats/%s/0", network, "0xB914ad493a0a4fe5a899dc21b66a509bcf8f1ED9"), env.admin, nil, &resp)
+		if rec.Code != http.StatusOK || resp.Total != 3 || resp.Claimed != 1 {
+			t.Errorf("stats: %d %s", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("no codes", func(t *testing.T) {
+		var resp offerStats
+		rec := env.do(env.s.AdminRouter, http.MethodGet, fmt.Sprintf("/%s/stats/%s/5", network, contract), env.admin,
+			nil, &resp)
+		if rec.Code != http.StatusOK || resp.Total != 0 || len(resp.ClaimRates) != 3 {
+			t.Errorf("stats: %d %s", rec.Code, rec.Body.String())
+		}
+	})
+}
+
+func TestAlerts(t *testing.T) {
+	type event struct {
+		Threshold string `json:"threshold"`
+		Limit     int    `json:"limit"`
+		Total     int    `json:"total"`
+		Remaining int    `json:"remaining"`
+	}
+	events := make(chan event, 10)
+	var attempts int32
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(r.Header.Get("X-Fulfillment-Timestamp") + "." + string(body)))
+		if r.Header.Get("X-Fulfillment-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("invalid signature of %s", body)
+		}
+		// the first attempt fails, and is retried
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var ev event
+		if err := json.Unmarshal(body, &ev); err != nil {
+			t.Errorf("invalid event %s: %v", body, err)
+		}
+		events <- ev
+	}))
+	defer webhook.Close()
+
+	env := newTestEnv(t, config.NetworkConfig{}, func(cfg *config.AuthorityConfig) {
+		cfg.Alerts = config.AlertConfig{
+			WebhookUrl:    webhook.URL,
+			WebhookSecret: "secret",
+			Timeout:       time.Second,
+			MaxAttempts:   3,
+			RetryBackoff:  time.Millisecond,
+			Thresholds:    map[string][]string{contract + "/0": {"1", "50%"}},
+		}
+	})
+	expect := func(thresholds ...string) {
+		t.Helper()
+		for _, threshold := range thresholds {
+			select {
+			case ev := <-events:
+				if ev.Threshold != threshold {
+					t.Errorf("alert %+v, want threshold %s", ev, threshold)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no alert, want threshold %s", threshold)
+			}
+		}
+		select {
+		case ev := <-events:
+			t.Errorf("unexpected alert %+v", ev)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	claim := func(tokenId int64) {
+		t.Helper()
+		if rec := env.fulfill(env.user, env.redeem(tokenId, 0), nil); rec.Code != http.StatusOK {
+			t.Fatalf("fulfill: %d %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	env.load(0, "CODE0", "CODE1", "CODE2", "CODE3")
+	claim(1)
+	expect()
+	claim(2)
+	expect("50%")
+	claim(3)
+	expect("1")
+	claim(4)
+	expect()
+
+	// a restock re-arms the thresholds the remaining codes are above again
+	env.load(0, "CODE4", "CODE5", "CODE6", "CODE7", "CODE8", "CODE9")
+	claim(5)
+	claim(6)
+	expect("50%")
+
+	t.Run("no webhook secret", func(t *testing.T) {
+		cfg := *env.s.Cfg
+		cfg.Alerts.WebhookSecret = ""
+		s := &server.Server{Cfg: &cfg, Chain: env.chain}
+		if err := fulfillmentd.Init(s); err == nil {
+			s.Close()
+			t.Error("alerts without a webhook secret")
+		}
+	})
+}
+
+func TestOfferRegistry(t *testing.T) {
+	env := newTestEnv(t, config.NetworkConfig{})
+	for _, offerId := range []int{0, 1, 2, 3, 4, 5} {
+		env.load(offerId, fmt.Sprintf("CODE%d", offerId))
+	}
+	now := time.Now().UTC()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+
+	t.Run("register", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			offerId int
+			body    interface{}
+			status  int
+		}{
+			{"disabled", 2, map[string]interface{}{"status": "disabled"}, http.StatusOK},
+			{"not yet valid", 3, map[string]interface{}{"valid_from": future}, http.StatusOK},
+			{"no longer valid", 4, map[string]interface{}{"valid_from": past.Add(-time.Hour), "valid_until": past},
+				http.StatusOK},
+			{"unknown status", 5, map[string]interface{}{"status": "unknown"}, http.StatusBadRequest},
+			{"empty window", 5, map[string]interface{}{"valid_from": future, "valid_until": past},
+				http.StatusBadRequest},
+			{"invalid offer id", 256, map[string]interface{}{}, http.StatusBadRequest},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if rec := env.register(tt.offerId, tt.body); rec.Code != tt.status {
+					t.Errorf("status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+				}
+			})
+		}
+
+		if rec := env.do(env.s.AdminRouter, http.MethodPut, fmt.Sprintf("/%s/offers/%s/0", network, contract),
+			env.user, map[string]interface{}{}, nil); rec.Code != http.StatusForbidden {
+			t.Errorf("not an admin: %d %s", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("get and list", func(t *testing.T) {
+		var offer struct {
+			Network string `json:"network"`
+			Name    string `json:"name"`
+			Status  string `json:"status"`
+		}
+		rec := env.do(env.s.AdminRouter, http.MethodGet, fmt.Sprintf("/%s/offers/%s/0", network, contract),
+			env.admin, nil, &offer)
+		if rec.Code != http.StatusOK || offer.Network != network || offer.Name != "test" || offer.Status != "active" {
+			t.Errorf("get: %d %s", rec.Code, rec.Body.String())
+		}
+		rec = env.do(env.s.AdminRouter, http.MethodGet, fmt.Sprintf("/%s/offers/%s/5", network, contract),
+			env.admin, nil, nil)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("get unregistered: %d %s", rec.Code, rec.Body.String())
+		}
+
+		var list struct {
+			Offers []interface{} `json:"offers"`
+		}
+		rec = env.do(env.s.AdminRouter, http.MethodGet, fmt.Sprintf("/%s/offers/%s", network, contract),
+			env.admin, nil, &list)
+		if rec.Code != http.StatusOK || len(list.Offers) != 5 {
+			t.Errorf("list: %d %s", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("fulfill", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			offerId uint8
+			status  string
+		}{
+			{"active", 0, "fulfilled"},
+			{"disabled", 2, "offer_unavailable"},
+			{"not yet valid", 3, "offer_unavailable"},
+			{"no longer valid", 4, "offer_unavailable"},
+			{"not registered", 5, "offer_unavailable"},
+		}
+		for i, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var resp fulfillResponse
+				env.fulfill(env.user, env.redeem(int64(i), tt.offerId), &resp)
+				if len(resp.Fulfillments) != 1 || resp.Fulfillments[0].Status != tt.status {
+					t.Errorf("status %+v, want %s", resp.Fulfillments, tt.status)
+				}
+			})
+		}
+	})
+
+	t.Run("claimed before registration", func(t *testing.T) {
+		// an offer claimed by a version without offer registration, and not registered since
+		const legacy = "0x0000000000000000000000000000000000000003"
+		fulfiller.Register(legacy, fulfiller.AnyOffer, legacyFulfiller{"1": {Claimed: true, Url: "https://live.eluv.io/",
+			Code: "LEGACY1"}})
+		fulfill := func(tokenId int64) (resp fulfillResponse) {
+			env.fulfill(env.user, env.chain.AddTx(ethtest.Tx{Redeems: []ethtest.Redeem{
+				{Contract: legacy, Redeemer: address(env.user), TokenId: tokenId, OfferId: 0},
+			}}), &resp)
+			return
+		}
+
+		if resp := fulfill(1); len(resp.Fulfillments) != 1 || resp.Fulfillments[0].Status != "already_fulfilled" ||
+			resp.Fulfillments[0].FulfillmentData.Code != "LEGACY1" {
+			t.Errorf("earlier claim: %+v", resp.Fulfillments)
+		}
+		if resp := fulfill(2); len(resp.Fulfillments) != 1 || resp.Fulfillments[0].Status != "offer_unavailable" {
+			t.Errorf("new claim: %+v", resp.Fulfillments)
+		}
+	})
+
+	t.Run("other network", func(t *testing.T) {
+		other := newTestEnv(t, config.NetworkConfig{})
+		other.register(0, map[string]interface{}{})
+		other.do(other.s.AdminRouter, http.MethodPut, fmt.Sprintf("/main/offers/%s/0", contract), other.admin,
+			map[string]interface{}{}, nil)
+		other.load(0, "ABC123")
+
+		var resp fulfillResponse
+		other.fulfill(other.user, other.redeem(1, 0), &resp)
+		if len(resp.Fulfillments) != 1 || resp.Fulfillments[0].Status != "offer_unavailable" {
+			t.Errorf("other network: %+v", resp.Fulfillments)
+		}
+	})
+
+	unclaimed := func(offerId int) int {
+		var resp struct {
+			Unclaimed []string `json:"unclaimed"`
+		}
+		env.do(env.s.AdminRouter, http.MethodGet, fmt.Sprintf("/%s/export/%s/%d", network, contract, offerId),
+			env.admin, nil, &resp)
+		return len(resp.Unclaimed)
+	}
+	for _, offerId := range []int{2, 3, 4, 5} {
+		if n := unclaimed(offerId); n != 1 {
+			t.Errorf("offer %d: %d codes left, want 1", offerId, n)
+		}
+	}
+}
+
+// legacyFulfiller holds the earlier fulfillments by token id, and never fulfills again
+type legacyFulfiller map[string]db.FulfillmentResponse
+
+func (f legacyFulfiller) FulfillRedeemableOffer(tx db.RedemptionTransaction) (db.FulfillmentResponse, error) {
+	return db.FulfillmentResponse{}, fmt.Errorf("no more codes for %+v", tx)
+}
+
+func (f legacyFulfiller) GetRedeemedOffer(_, _, tokenId string) (db.FulfillmentResponse, error) {
+	return f[tokenId], nil
+}
+
+func TestOfferLifecycle(t *testing.T) {
+	env := newTestEnv(t, config.NetworkConfig{})
+	env.load(0, "CODE0", "CODE1", "CODE2", "CODE3")
+	claimed := env.redeem(1, 0)
+
+	setStatus := func(action string, want int) {
+		t.Helper()
+		path := fmt.Sprintf("/%s/offers/%s/0/%s", network, contract, action)
+		if rec := env.do(env.s.AdminRouter, http.MethodPost, path, env.admin, nil, nil); rec.Code != want {
+			t.Errorf("%s: status %d, want %d: %s", action, rec.Code, want, rec.Body.String())
+		}
+	}
+	check := func(name, tx, want string) {
+		t.Helper()
+		var resp fulfillResponse
+		env.fulfill(env.user, tx, &resp)
+		if len(resp.Fulfillments) != 1 || resp.Fulfillments[0].Status != want {
+			t.Errorf("%s: %+v, want %s", name, resp.Fulfillments, want)
+		}
+	}
+
+	check("active", claimed, "fulfilled")
+
+	setStatus("pause", http.StatusOK)
+	paused := env.redeem(2, 0)
+	check("paused", paused, "offer_unavailable")
+	check("paused, claimed before", claimed, "already_fulfilled")
+
+	setStatus("resume", http.StatusOK)
+	check("resumed", paused, "fulfilled")
+
+	env.register(0, map[string]interface{}{"valid_until": time.Now().Add(-time.Minute)})
+	check("expired", env.redeem(3, 0), "offer_unavailable")
+	check("expired, claimed before", claimed, "already_fulfilled")
+	env.register(0, map[string]interface{}{})
+
+	setStatus("retire", http.StatusOK)
+	check("retired", env.redeem(4, 0), "offer_unavailable")
+	check("retired, claimed before", claimed, "already_fulfilled")
+
+	setStatus("resume", http.StatusBadRequest)
+	setStatus("pause", http.StatusBadRequest)
+	if rec := env.register(0, map[string]interface{}{"status": "active"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("reactivate retired: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.register(0, map[string]interface{}{"name": "renamed"}); rec.Code != http.StatusOK {
+		t.Errorf("rename retired: %d %s", rec.Code, rec.Body.String())
+	}
+	check("renamed, still retired", env.redeem(5, 0), "offer_unavailable")
+
+	path := fmt.Sprintf("/%s/offers/%s/5/pause", network, contract)
+	if rec := env.do(env.s.AdminRouter, http.MethodPost, path, env.admin, nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("pause unregistered: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestConcurrentClaims(t *testing.T) {
+	env := newTestEnv(t, config.NetworkConfig{})
+	const codes = 5
+	var loaded []string
+	for i := 0; i < codes; i++ {
+		loaded = append(loaded, fmt.Sprintf("CODE%d", i))
+	}
+	env.load(0, loaded...)
+
+	// twice as many tokens as codes, each requesting twice at once
+	var txs []string
+	for tokenId := int64(0); tokenId < 2*codes; tokenId++ {
+		txs = append(txs, env.redeem(tokenId, 0))
+	}
+	var mutex sync.Mutex
+	codesByTx := make(map[string]map[string]bool)
+	var wg sync.WaitGroup
+	for _, tx := range append(txs, txs...) {
+		wg.Add(1)
+		go func(tx string) {
+			defer wg.Done()
+			var resp fulfillResponse
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/%s/fulfill/%s", network, tx), nil)
+			req.Header.Set("Authorization", "Bearer "+env.token(env.user))
+			rec := httptest.NewRecorder()
+			env.s.Router.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				return
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Error(err)
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if codesByTx[tx] == nil {
+				codesByTx[tx] = make(map[string]bool)
+			}
+			codesByTx[tx][resp.Fulfillments[0].FulfillmentData.Code] = true
+		}(tx)
+	}
+	wg.Wait()
+
+	if len(codesByTx) != codes {
+		t.Errorf("%d tokens fulfilled, want %d", len(codesByTx), codes)
+	}
+	claimed := make(map[string]string)
+	for tx, txCodes := range codesByTx {
+		if len(txCodes) != 1 {
+			t.Errorf("tx %s got several codes: %v", tx, txCodes)
+		}
+		for code := range txCodes {
+			if other, ok := claimed[code]; ok {
+				t.Errorf("code %s claimed by tx %s and %s", code, tx, other)
+			}
+			claimed[code] = tx
+		}
+	}
+}
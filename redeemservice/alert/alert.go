@@ -0,0 +1,334 @@
+// Package alert posts low-inventory webhooks, so that the code pool of an offer is restocked before users run out.
+//
+// Each offer may have thresholds of remaining codes, absolute ("100") or a percentage of the codes loaded ("10%").
+// After each claim, a threshold the remaining codes fell to fires a signed webhook, once: the alert is recorded in the
+// DB, and only fires again after a load restocks the offer above the threshold.
+//
+// The webhook is a POST of an Event as json, with the headers:
+//
+//	X-Fulfillment-Timestamp: <unix seconds>
+//	X-Fulfillment-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>" keyed by alerts.webhook_secret>
+package alert
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"fulfillmentd/redeemservice/db"
+	"fulfillmentd/server/config"
+	"fulfillmentd/utils"
+	"github.com/eluv-io/errors-go"
+	elog "github.com/eluv-io/log-go"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var log = elog.Get("/fs/alert")
+
+const (
+	EventLowInventory = "low_inventory"
+
+	TimestampHeader = "X-Fulfillment-Timestamp"
+	SignatureHeader = "X-Fulfillment-Signature"
+)
+
+// Event is the body of a webhook: the threshold of the offer crossed, and the inventory at the time.
+type Event struct {
+	Event           string    `json:"event"`
+	ContractAddress string    `json:"contract_address"`
+	OfferId         string    `json:"offer_id"`
+	Threshold       string    `json:"threshold"`
+	Limit           int       `json:"limit"` // remaining codes at or below which the threshold is crossed
+	Total           int       `json:"total"`
+	Claimed         int       `json:"claimed"`
+	Remaining       int       `json:"remaining"`
+	Fired           time.Time `json:"fired"`
+}
+
+// Threshold is a number of remaining codes, or a percentage of the codes loaded, at or below which an offer alerts.
+type Threshold struct {
+	Name    string // canonical, e.g. "100" or "10%"; identifies the alert of the threshold in the DB
+	Value   float64
+	Percent bool
+}
+
+// ParseThreshold parses a threshold of remaining codes, "N", or a percentage of the codes loaded, "N%".
+func ParseThreshold(s string) (th Threshold, err error) {
+	value := strings.TrimSpace(s)
+	if th.Percent = strings.HasSuffix(value, "%"); th.Percent {
+		value = strings.TrimSpace(strings.TrimSuffix(value, "%"))
+	}
+	if th.Value, err = strconv.ParseFloat(value, 64); err != nil || th.Value < 0 || (th.Percent && th.Value > 100) ||
+		(!th.Percent && th.Value != math.Trunc(th.Value)) {
+		err = errors.NoTrace("invalid alert threshold", errors.K.Invalid, err, "threshold", s)
+		return
+	}
+
+	th.Name = strconv.FormatFloat(th.Value, 'f', -1, 64)
+	if th.Percent {
+		th.Name += "%"
+	}
+	return
+}
+
+// Limit returns the remaining codes at or below which the threshold is crossed, of `total` codes loaded.
+func (th Threshold) Limit(total int) int {
+	if th.Percent {
+		return int(math.Floor(float64(total) * th.Value / 100))
+	}
+	return int(th.Value)
+}
+
+// maxPendingChecks is the number of checks queued before more are dropped
+const maxPendingChecks = 1000
+
+// Alerter checks the thresholds of offers after claims and loads, and posts the webhooks, in the background.
+type Alerter struct {
+	cfg        config.AlertConfig
+	db         *db.FulfillmentPersistence
+	thresholds map[string][]Threshold // by offer, "<contract>/<offer id>" or "<contract>/*"
+	client     *http.Client
+
+	checks chan check // of the claims, in order
+	mu     sync.Mutex // serializes evaluations, so that a restock and a claim of an offer see each other's alert
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type check struct {
+	contractAddr string
+	offerId      string
+	thresholds   []Threshold
+}
+
+func NewAlerter(cfg config.AlertConfig, fp *db.FulfillmentPersistence) (a *Alerter, err error) {
+	if cfg.WebhookSecret == "" {
+		err = errors.NoTrace("invalid alerts config", errors.K.Invalid, "reason", "no webhook_secret")
+		return
+	}
+
+	a = &Alerter{
+		cfg:        cfg,
+		db:         fp,
+		thresholds: make(map[string][]Threshold),
+		client:     &http.Client{Timeout: cfg.Timeout},
+		checks:     make(chan check, maxPendingChecks),
+	}
+	for offer, thresholds := range cfg.Thresholds {
+		for _, s := range thresholds {
+			var th Threshold
+			if th, err = ParseThreshold(s); err != nil {
+				err = errors.NoTrace("invalid alerts config", errors.K.Invalid, err, "offer", offer)
+				return nil, err
+			}
+			a.thresholds[offer] = append(a.thresholds[offer], th)
+		}
+	}
+	if a.cfg.MaxAttempts < 1 {
+		a.cfg.MaxAttempts = 1
+	}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	log.Info("init Alerter", "webhook_url", cfg.WebhookUrl, "thresholds", cfg.Thresholds)
+
+	a.wg.Add(1)
+	go a.run()
+
+	return
+}
+
+// Claimed queues a check of the thresholds of the offer after a claim, posting the webhook of each newly crossed
+// threshold; it never blocks.
+func (a *Alerter) Claimed(contractAddr, offerId string) {
+	thresholds := a.thresholdsFor(contractAddr, offerId)
+	if len(thresholds) == 0 {
+		return
+	}
+
+	select {
+	case a.checks <- check{contractAddr: contractAddr, offerId: offerId, thresholds: thresholds}:
+	default:
+		log.Warn("too many pending alert checks; dropping", "contract_addr", contractAddr, "offer_id", offerId)
+	}
+}
+
+// Restocked re-arms the alerts of the offer after a load, for each threshold the remaining codes are above again. It
+// runs before the load returns, so that the claims after it cannot lower the remaining codes first.
+func (a *Alerter) Restocked(contractAddr, offerId string) {
+	thresholds := a.thresholdsFor(contractAddr, offerId)
+	if len(thresholds) == 0 {
+		return
+	}
+
+	a.mu.Lock()
+	_, err := a.evaluate(contractAddr, offerId, thresholds, true)
+	a.mu.Unlock()
+	if err != nil {
+		log.Warn("error re-arming alerts", "contract_addr", contractAddr, "offer_id", offerId, "err", err)
+	}
+}
+
+// Close stops checking and retrying webhooks, and waits for the check and webhooks in progress.
+func (a *Alerter) Close() {
+	a.cancel()
+	a.wg.Wait()
+}
+
+// run evaluates the queued checks of the claims in order, posting the webhooks of each concurrently
+func (a *Alerter) run() {
+	defer a.wg.Done()
+
+	for {
+		var c check
+		select {
+		case <-a.ctx.Done():
+			return
+		case c = <-a.checks:
+		}
+
+		a.mu.Lock()
+		events, err := a.evaluate(c.contractAddr, c.offerId, c.thresholds, false)
+		a.mu.Unlock()
+		if err != nil {
+			log.Warn("error checking alert thresholds", "contract_addr", c.contractAddr, "offer_id", c.offerId,
+				"err", err)
+		}
+		for _, ev := range events {
+			a.wg.Add(1)
+			go a.fire(ev)
+		}
+	}
+}
+
+// fire posts the webhook of `ev`, or else re-arms its alert, so that the next claim tries again
+func (a *Alerter) fire(ev Event) {
+	defer a.wg.Done()
+
+	err := a.post(ev)
+	if err == nil {
+		log.Info("posted low-inventory alert", "event", ev)
+		return
+	}
+	log.Error("error posting low-inventory alert", "event", ev, "err", err)
+	if err = a.db.DeleteAlert(ev.ContractAddress, ev.OfferId, ev.Threshold); err != nil {
+		log.Warn("error re-arming alert", "event", ev, "err", err)
+	}
+}
+
+// evaluate returns the events of the thresholds newly crossed after a claim, or re-arms the alerts of the thresholds
+// no longer crossed after a restock.
+func (a *Alerter) evaluate(contractAddr, offerId string, thresholds []Threshold,
+	restocked bool) (events []Event, err error) {
+	var stats []db.OfferStats
+	if stats, err = a.db.GetStats(contractAddr, offerId, time.Now()); err != nil || len(stats) == 0 {
+		return
+	}
+	st := stats[0]
+	if st.Total == 0 {
+		return
+	}
+
+	for _, th := range thresholds {
+		limit := th.Limit(st.Total)
+		if restocked {
+			if st.Remaining > limit {
+				if err = a.db.DeleteAlert(contractAddr, offerId, th.Name); err != nil {
+					return
+				}
+			}
+			continue
+		}
+
+		if st.Remaining > limit {
+			continue
+		}
+		var added bool
+		if added, err = a.db.AddAlert(contractAddr, offerId, th.Name); err != nil {
+			return
+		}
+		if added {
+			events = append(events, Event{
+				Event:           EventLowInventory,
+				ContractAddress: contractAddr,
+				OfferId:         offerId,
+				Threshold:       th.Name,
+				Limit:           limit,
+				Total:           st.Total,
+				Claimed:         st.Claimed,
+				Remaining:       st.Remaining,
+				Fired:           time.Now().UTC(),
+			})
+		}
+	}
+
+	return
+}
+
+// thresholdsFor returns the thresholds of the offer, or else those of all offers of the contract
+func (a *Alerter) thresholdsFor(contractAddr, offerId string) []Threshold {
+	contractAddr = utils.NormalizeAddress(contractAddr)
+	if thresholds, ok := a.thresholds[contractAddr+"/"+offerId]; ok {
+		return thresholds
+	}
+	return a.thresholds[contractAddr+"/*"]
+}
+
+// post sends the webhook of `ev`, retrying failures with a backoff doubling from alerts.retry_backoff_ms, up to
+// alerts.max_attempts; a response 4xx other than 408 and 429 is not retried.
+func (a *Alerter) post(ev Event) (err error) {
+	var body []byte
+	if body, err = json.Marshal(ev); err != nil {
+		return
+	}
+
+	backoff := a.cfg.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		if err = a.send(body); err == nil || attempt >= a.cfg.MaxAttempts || errors.IsKind(errors.K.Invalid, err) {
+			return
+		}
+		log.Warn("error posting webhook, retrying", "attempt", attempt, "backoff", backoff, "err", err)
+
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (a *Alerter) send(body []byte) (err error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(a.cfg.WebhookSecret))
+	_, _ = fmt.Fprintf(mac, "%s.%s", timestamp, body)
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(a.ctx, http.MethodPost, a.cfg.WebhookUrl, bytes.NewReader(body)); err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	var resp *http.Response
+	if resp, err = a.client.Do(req); err != nil {
+		return errors.NoTrace("webhook unreachable", errors.K.Unavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch code := resp.StatusCode; {
+	case code >= 200 && code < 300:
+		return nil
+	case code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests:
+		return errors.NoTrace("webhook rejected", errors.K.Invalid, "status", resp.Status)
+	}
+	return errors.NoTrace("webhook failed", errors.K.Unavailable, "status", resp.Status)
+}
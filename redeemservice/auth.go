@@ -0,0 +1,50 @@
+package api
+
+import (
+	"fulfillmentd/server"
+	"fulfillmentd/utils"
+	"github.com/eluv-io/common-go/format/eat"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// tokenTimeSkew is the tolerated clock difference when checking when a bearer token was issued
+const tokenTimeSkew = time.Minute
+
+// AdminAuth only lets requests through whose bearer token is signed by an admin of the route's `contract_addr`.
+// It responds 401 for a missing or invalid token, and 403 if the signer is not an admin.
+func AdminAuth(fs *server.FulfillmentService) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var err error
+
+		var tok *eat.Token
+		if tok, err = utils.ParseAuthToken(ctx.Request); err == nil {
+			if err = tok.VerifySignature(); err == nil {
+				err = tok.VerifyTimes(0, tokenTimeSkew)
+			}
+		}
+		if err != nil {
+			log.Warn("invalid admin auth token", "err", err)
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"message": "invalid authorization token",
+				"err":     err,
+			})
+			return
+		}
+
+		signer := strings.ToLower(tok.EthAddr.Hex())
+		if err = fs.AuthorizeAdmin(ctx.Param("network"), ctx.Param("contract_addr"), signer); err != nil {
+			log.Warn("unauthorized admin request", "signer", signer, "err", err)
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"message": "not authorized",
+				"err":     err,
+			})
+			return
+		}
+
+		log.Debug("admin request", "signer", signer, "path", ctx.Request.URL.Path)
+		ctx.Next()
+	}
+}
@@ -0,0 +1,347 @@
+package db
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"fulfillmentd/server/db"
+	"github.com/eluv-io/errors-go"
+	"github.com/jackc/pgx"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// migrations are versioned schema changes named `<version>_<name>.up.sql` and `<version>_<name>.down.sql`. They are
+// templates merged with the same context as the statements in sql/, and should be idempotent since a failed migration
+// is not rolled back. A migration file runs as one implicit transaction, in which CockroachDB rejects a schema change
+// after a write: a data change goes in its own migration, before the schema change that depends on it.
+//
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+const (
+	pgUndefinedTable    = "42P01"
+	pgUndefinedDatabase = "3D000"
+)
+
+type Migration struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	up      string
+	down    string
+}
+
+type MigrationStatus struct {
+	Version int       `json:"version"`
+	Name    string    `json:"name"`
+	Applied bool      `json:"applied"`
+	Created time.Time `json:"created,omitempty"`
+}
+
+// Migrator applies the embedded migrations and records the applied versions in the schema_migrations table. Migrators
+// of concurrent instances take turns: each holds the row of the schema_migrations_lock table in a transaction while it
+// applies or reverts migrations, on another connection of the pool.
+type Migrator struct {
+	pool       *db.ConnectionManager
+	migrations []Migration
+}
+
+func NewMigrator(cm *db.ConnectionManager) (m *Migrator, err error) {
+	var migrations []Migration
+	if migrations, err = loadMigrations(); err != nil {
+		return
+	}
+	m = &Migrator{pool: cm, migrations: migrations}
+	return
+}
+
+// LatestVersion returns the newest schema version known to this binary.
+func (m *Migrator) LatestVersion() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// CurrentVersion returns the newest schema version applied to the database, 0 if none.
+func (m *Migrator) CurrentVersion() (version int, err error) {
+	var applied map[int]MigrationStatus
+	if applied, err = m.applied(); err != nil {
+		return
+	}
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return
+}
+
+// CheckVersion returns an error if the database schema is newer than this binary knows.
+func (m *Migrator) CheckVersion() (err error) {
+	var current int
+	if current, err = m.CurrentVersion(); err != nil {
+		return
+	}
+
+	latest := m.LatestVersion()
+	switch {
+	case current > latest:
+		err = errors.E("CheckVersion", errors.K.Invalid, "reason", "database schema is newer than this binary",
+			"schema_version", current, "binary_version", latest)
+	case current < latest:
+		log.Warn("database schema is behind; run migrations", "schema_version", current, "binary_version", latest)
+	default:
+		log.Info("database schema is current", "schema_version", current)
+	}
+	return
+}
+
+// Up applies all migrations not yet applied, in version order.
+func (m *Migrator) Up() (applied []Migration, err error) {
+	if err = m.createSchemaTable(); err != nil {
+		return
+	}
+
+	var unlock func()
+	if unlock, err = m.lock(); err != nil {
+		return
+	}
+	defer unlock()
+
+	var done map[int]MigrationStatus
+	if done, err = m.applied(); err != nil {
+		return
+	}
+
+	applied = make([]Migration, 0)
+	for _, mig := range m.migrations {
+		if _, ok := done[mig.Version]; ok {
+			continue
+		}
+		log.Info("applying migration", "version", mig.Version, "name", mig.Name)
+		if err = m.exec(mig.up); err != nil {
+			err = errors.E("Up", errors.K.Invalid, err, "version", mig.Version, "name", mig.Name)
+			return
+		}
+		if err = m.record("sql/add-schema-migration.tmpl", mig.Version, mig.Name); err != nil {
+			return
+		}
+		applied = append(applied, mig)
+	}
+
+	return
+}
+
+// Down reverts the newest applied migration. It returns nil if no migration is applied.
+func (m *Migrator) Down() (reverted *Migration, err error) {
+	if err = m.createSchemaTable(); err != nil {
+		return
+	}
+
+	var unlock func()
+	if unlock, err = m.lock(); err != nil {
+		return
+	}
+	defer unlock()
+
+	var current int
+	if current, err = m.CurrentVersion(); err != nil || current == 0 {
+		return
+	}
+
+	for i := range m.migrations {
+		if m.migrations[i].Version == current {
+			reverted = &m.migrations[i]
+		}
+	}
+	if reverted == nil {
+		err = errors.E("Down", errors.K.NotExist, "reason", "applied migration unknown to this binary",
+			"version", current)
+		return
+	}
+
+	log.Info("reverting migration", "version", reverted.Version, "name", reverted.Name)
+	if err = m.exec(reverted.down); err != nil {
+		err = errors.E("Down", errors.K.Invalid, err, "version", reverted.Version, "name", reverted.Name)
+		return
+	}
+	err = m.record("sql/delete-schema-migration.tmpl", reverted.Version)
+
+	return
+}
+
+// Status returns every known or applied migration with whether it has been applied.
+func (m *Migrator) Status() (status []MigrationStatus, err error) {
+	var applied map[int]MigrationStatus
+	if applied, err = m.applied(); err != nil {
+		return
+	}
+
+	status = make([]MigrationStatus, 0)
+	for _, mig := range m.migrations {
+		st, ok := applied[mig.Version]
+		if !ok {
+			st = MigrationStatus{Version: mig.Version, Name: mig.Name}
+		}
+		delete(applied, mig.Version)
+		status = append(status, st)
+	}
+	// applied by a newer binary
+	for _, st := range applied {
+		status = append(status, st)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+
+	return
+}
+
+func (m *Migrator) createSchemaTable() (err error) {
+	var stmt string
+	if stmt, err = mergeTemplate("sql/create-schema-migrations.tmpl", dbContext()); err != nil {
+		return
+	}
+	_, err = m.pool.GetConn().Exec(stmt)
+	return
+}
+
+// lock waits for the migrations lock, and holds it until `unlock` is called. The lock is held by a transaction on one
+// connection of the pool, so migrations need at least one other.
+func (m *Migrator) lock() (unlock func(), err error) {
+	pool := m.pool.GetConn()
+	if pool.Stat().MaxConnections < 2 {
+		err = errors.E("lock", errors.K.Invalid, "reason", "migrations need a db.max_conn of 2 or more",
+			"max_conn", pool.Stat().MaxConnections)
+		return
+	}
+
+	var stmt string
+	if stmt, err = mergeTemplate("sql/lock-schema-migrations.tmpl", dbContext()); err != nil {
+		return
+	}
+
+	var dbTx *pgx.Tx
+	if dbTx, err = pool.Begin(); err != nil {
+		return
+	}
+	if _, err = dbTx.Exec(stmt); err != nil {
+		_ = dbTx.Rollback()
+		err = errors.E("lock", errors.K.Unavailable, err, "reason", "cannot lock migrations")
+		return
+	}
+	log.Debug("locked migrations")
+
+	unlock = func() {
+		if err := dbTx.Rollback(); err != nil {
+			log.Warn("error unlocking migrations", "err", err)
+		}
+	}
+	return
+}
+
+// applied returns the applied migrations by version; none if the schema_migrations table does not exist yet.
+func (m *Migrator) applied() (applied map[int]MigrationStatus, err error) {
+	applied = make(map[int]MigrationStatus)
+
+	var stmt string
+	if stmt, err = mergeTemplate("sql/get-schema-migrations.tmpl", dbContext()); err != nil {
+		return
+	}
+
+	var rows *pgx.Rows
+	if rows, err = m.pool.GetConn().Query(stmt); err != nil {
+		if isPgError(err, pgUndefinedTable) || isPgError(err, pgUndefinedDatabase) {
+			err = nil
+		}
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int64
+		var name sql.NullString
+		var created sql.NullTime
+		if err = rows.Scan(&version, &name, &created); err != nil {
+			return
+		}
+		applied[int(version)] = MigrationStatus{
+			Version: int(version),
+			Name:    name.String,
+			Applied: true,
+			Created: created.Time,
+		}
+	}
+	err = rows.Err()
+
+	return
+}
+
+func (m *Migrator) exec(file string) (err error) {
+	var stmt string
+	if stmt, err = mergeTemplateFS(migrationsFS, file, dbContext()); err != nil {
+		return
+	}
+	_, err = m.pool.GetConn().Exec(stmt)
+	return
+}
+
+func (m *Migrator) record(tmpl string, args ...interface{}) (err error) {
+	var stmt string
+	if stmt, err = mergeTemplate(tmpl, dbContext()); err != nil {
+		return
+	}
+	_, err = m.pool.GetConn().Exec(stmt, args...)
+	return
+}
+
+func loadMigrations() (migrations []Migration, err error) {
+	var entries []fs.DirEntry
+	if entries, err = fs.ReadDir(migrationsFS, "migrations"); err != nil {
+		return
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := migrationFile.FindStringSubmatch(entry.Name())
+		if match == nil {
+			err = errors.E("loadMigrations", errors.K.Invalid, "reason", "invalid migration file name",
+				"file", entry.Name())
+			return
+		}
+		version, _ := strconv.Atoi(match[1])
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = mig
+		} else if mig.Name != match[2] {
+			err = errors.E("loadMigrations", errors.K.Invalid, "reason", "conflicting migration names",
+				"version", version, "names", fmt.Sprintf("%s, %s", mig.Name, match[2]))
+			return
+		}
+		file := path.Join("migrations", entry.Name())
+		if match[3] == "up" {
+			mig.up = file
+		} else {
+			mig.down = file
+		}
+	}
+
+	migrations = make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.up == "" || mig.down == "" {
+			err = errors.E("loadMigrations", errors.K.Invalid, "reason", "migration needs both up and down",
+				"version", mig.Version, "name", mig.Name)
+			return
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return
+}
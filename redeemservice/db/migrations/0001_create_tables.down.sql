@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS {{.database}}.redeemable_offer_claims;
+DROP TABLE IF EXISTS {{.database}}.fulfillment_service;
@@ -2,12 +2,11 @@
 -- DB tables for FulfillmentService
 --
 
-CREATE DATABASE IF NOT EXISTS fulfillmentservice;
-USE fulfillmentservice;
+CREATE DATABASE IF NOT EXISTS {{.database}};
 
 
 --- Aggregate table for combined service: library storage plus code+url fulfillment
-CREATE TABLE IF NOT EXISTS fulfillment_service (
+CREATE TABLE IF NOT EXISTS {{.database}}.fulfillment_service (
     id                UUID NOT NULL DEFAULT gen_random_uuid() PRIMARY KEY,
     --  these are loaded on setup
     contract_addr     text NOT NULL,
@@ -21,12 +20,12 @@ CREATE TABLE IF NOT EXISTS fulfillment_service (
     created           timestamptz NOT NULL DEFAULT now(),
     updated           timestamptz NOT NULL DEFAULT now()
 );
-CREATE INDEX IF NOT EXISTS fs_contract_addr_idx ON fulfillment_service (contract_addr);
-CREATE INDEX IF NOT EXISTS fs_claimer_user_addr_idx ON fulfillment_service (claimer_user_addr);
+CREATE INDEX IF NOT EXISTS fs_contract_addr_idx ON {{.database}}.fulfillment_service (contract_addr);
+CREATE INDEX IF NOT EXISTS fs_claimer_user_addr_idx ON {{.database}}.fulfillment_service (claimer_user_addr);
 
 
 --- Storage for a library-provided Redeemable Offer Fulfillment Daemon accepted claims
-CREATE TABLE IF NOT EXISTS redeemable_offer_claims (
+CREATE TABLE IF NOT EXISTS {{.database}}.redeemable_offer_claims (
     id                UUID NOT NULL DEFAULT gen_random_uuid() PRIMARY KEY,
     contract_addr     text NOT NULL,
     offer_id          text NOT NULL,
@@ -34,5 +33,5 @@ CREATE TABLE IF NOT EXISTS redeemable_offer_claims (
     user_addr         text NOT NULL,
     created           timestamptz NOT NULL DEFAULT now()
 );
-CREATE INDEX IF NOT EXISTS roc_contract_addr_idx ON redeemable_offer_claims (contract_addr);
-CREATE INDEX IF NOT EXISTS roc_claimer_user_addr_idx ON redeemable_offer_claims (user_addr);
+CREATE INDEX IF NOT EXISTS roc_contract_addr_idx ON {{.database}}.redeemable_offer_claims (contract_addr);
+CREATE INDEX IF NOT EXISTS roc_claimer_user_addr_idx ON {{.database}}.redeemable_offer_claims (user_addr);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS {{.database}}.fulfillment_service@fs_claimer_token_idx;
@@ -0,0 +1,2 @@
+-- a token claims at most one code per offer; unclaimed rows have a NULL claimer_token_id and do not conflict
+CREATE UNIQUE INDEX IF NOT EXISTS fs_claimer_token_idx ON {{.database}}.fulfillment_service (contract_addr, redeemable_id, claimer_token_id);
@@ -0,0 +1,13 @@
+--- Registry of the redeemable offers fulfilled by the service; redemptions of unregistered offers are rejected
+CREATE TABLE IF NOT EXISTS {{.database}}.redeemable_offers (
+    contract_addr     text NOT NULL,
+    offer_id          text NOT NULL,
+    network           text NOT NULL,
+    name              text NOT NULL DEFAULT '',
+    valid_from        timestamptz,
+    valid_until       timestamptz,
+    status            text NOT NULL DEFAULT 'active',
+    created           timestamptz NOT NULL DEFAULT now(),
+    updated           timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (contract_addr, offer_id)
+);
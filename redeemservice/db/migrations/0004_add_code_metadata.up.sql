@@ -0,0 +1,2 @@
+-- optional metadata of an imported code, kept for the admins
+ALTER TABLE {{.database}}.fulfillment_service ADD COLUMN IF NOT EXISTS metadata JSONB;
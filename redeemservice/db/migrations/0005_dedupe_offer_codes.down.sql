@@ -0,0 +1,2 @@
+-- the duplicate codes removed are not restored
+SELECT 1;
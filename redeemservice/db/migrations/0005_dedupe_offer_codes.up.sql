@@ -0,0 +1,28 @@
+-- keep one row per code of an offer: the one claimed by a token if any, else the oldest. Rows only marked claimed as
+-- duplicates of a claimed url and code have no claimer token, and are removed with the other duplicates.
+--
+-- A code claimed by more than one token is not resolved here, since removing either claim would let its token claim
+-- another code: the migration fails, naming such a code, until each is resolved by hand, e.g. by giving all but the
+-- oldest claim another code. It is separate from the unique index of 0006, as CockroachDB does not allow a schema
+-- change after a write in the same transaction.
+SELECT crdb_internal.force_error('23505', 'cannot make codes unique per offer: ' || count(*)::STRING ||
+    ' codes claimed by more than one token, e.g. ' || min(claimed.code_id) || '; resolve them and migrate again')
+FROM (
+    SELECT contract_addr || '/' || redeemable_id || '/' || code AS code_id
+    FROM {{.database}}.fulfillment_service
+    WHERE claimer_token_id IS NOT NULL
+    GROUP BY contract_addr, redeemable_id, code
+    HAVING count(*) > 1
+) AS claimed
+HAVING count(*) > 0;
+
+DELETE FROM {{.database}}.fulfillment_service WHERE id IN (
+    SELECT id FROM (
+        SELECT id, claimer_token_id, row_number() OVER (
+            PARTITION BY contract_addr, redeemable_id, code
+            ORDER BY claimer_token_id IS NULL, created, id
+        ) AS n
+        FROM {{.database}}.fulfillment_service
+    ) AS dups
+    WHERE n > 1 AND claimer_token_id IS NULL
+);
@@ -0,0 +1,2 @@
+-- a code is loaded at most once per offer; the duplicates are removed by 0005
+CREATE UNIQUE INDEX IF NOT EXISTS fs_offer_code_idx ON {{.database}}.fulfillment_service (contract_addr, redeemable_id, code);
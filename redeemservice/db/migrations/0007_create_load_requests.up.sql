@@ -0,0 +1,7 @@
+--- Loads made with an Idempotency-Key, and their result, returned again when the load is retried with the same key
+CREATE TABLE IF NOT EXISTS {{.database}}.load_requests (
+    idempotency_key   text NOT NULL PRIMARY KEY,
+    request_hash      text NOT NULL,
+    result            JSONB NOT NULL,
+    created           timestamptz NOT NULL DEFAULT now()
+);
@@ -0,0 +1 @@
+ALTER TABLE {{.database}}.fulfillment_service DROP COLUMN IF EXISTS payload;
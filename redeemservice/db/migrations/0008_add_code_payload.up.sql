@@ -0,0 +1,2 @@
+-- optional fulfillment payload of a code, delivered verbatim instead of its url and code
+ALTER TABLE {{.database}}.fulfillment_service ADD COLUMN IF NOT EXISTS payload JSONB;
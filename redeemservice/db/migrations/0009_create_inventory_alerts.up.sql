@@ -0,0 +1,8 @@
+--- Low-inventory alerts fired, by offer and threshold; an alert fires again only once its row is deleted on restock
+CREATE TABLE IF NOT EXISTS {{.database}}.inventory_alerts (
+    contract_addr     text NOT NULL,
+    offer_id          text NOT NULL,
+    threshold         text NOT NULL,
+    created           timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (contract_addr, offer_id, threshold)
+);
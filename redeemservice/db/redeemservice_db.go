@@ -1,37 +1,89 @@
 package db
 
 import (
-	"bytes"
-	"database/sql"
-	"embed"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"fulfillmentd/server/db"
-	"fulfillmentd/utils"
+	"fulfillmentd/server/config"
+	"fulfillmentd/server/eth"
 	"github.com/eluv-io/errors-go"
 	elog "github.com/eluv-io/log-go"
-	"github.com/jackc/pgx"
-	"io/fs"
-	"regexp"
-	"strconv"
-	"text/template"
+	"strings"
 	"time"
 )
 
-//go:embed sql/*.tmpl
-var statementsFS embed.FS
-
 var log = elog.Get("/fs/db")
 
+// Store persists the code pool of each contract and offer, and the claims made against it.
+type Store interface {
+	// SetupFulfillment adds the Entries of a validated `setup`, with distinct codes, to the pool as unclaimed, except
+	// codes already in the pool, all in one transaction. With an IdempotencyKey, the result is
+	// recorded in the same transaction, and a later setup with the same key gets the recorded result, Replayed,
+	// without loading anything; it fails with an error of kind Exist if its request hash differs.
+	SetupFulfillment(setup SetupData) (SetupResult, error)
+
+	// ClaimCode claims one unclaimed url and code of the contract and offer in `tx` for its token, and marks rows
+	// with the same url and code claimed. The whole claim is atomic: a token claims at most one code, even with
+	// concurrent requests.
+	ClaimCode(tx RedemptionTransaction) (FulfillmentResponse, error)
+
+	// GetRedeemedOffer returns the code claimed by the token; Claimed is false if none.
+	GetRedeemedOffer(contractAddr, redeemableId, tokenId string) (FulfillmentResponse, error)
+
+	// GetUnclaimed lists the unclaimed codes of the contract and offer.
+	GetUnclaimed(contractAddr, redeemableId string) ([]string, error)
+
+	// GetStats returns the inventory of the offer of the contract, or of each of its offers with codes if `offerId`
+	// is empty, by offer id, with ClaimRates of the number of claims by a token since each of `since`.
+	GetStats(contractAddr, offerId string, since []time.Time) ([]OfferStats, error)
+
+	// AddAlert records the low-inventory alert of the threshold as fired for the offer, and tells whether it was not
+	// yet; only the caller that adds it fires the alert.
+	AddAlert(contractAddr, offerId, threshold string) (added bool, err error)
+
+	// DeleteAlert re-arms the low-inventory alert of the threshold for the offer, if fired.
+	DeleteAlert(contractAddr, offerId, threshold string) error
+
+	// ImportCodes adds the validated `rows`, with distinct codes, to the pool of the contract and offer as unclaimed,
+	// except those with a code already in the pool, which it returns.
+	ImportCodes(contractAddr, offerId string, rows []ImportRow) (duplicates []string, err error)
+
+	// PutOffer registers a validated `offer`, or replaces the registration of its contract and offer, and returns it
+	// as stored.
+	PutOffer(offer Offer) (Offer, error)
+
+	// GetOffer returns the registered offer; the error is of kind NotExist if it is not registered.
+	GetOffer(contractAddr, offerId string) (Offer, error)
+
+	// ListOffers lists the registered offers of the contract, or of all contracts if empty.
+	ListOffers(contractAddr string) ([]Offer, error)
+}
+
 type FulfillmentPersistence struct {
-	pool            *db.ConnectionManager
-	ethUrlByNetwork map[string]string
+	store    Store
+	chain    eth.Backends
+	networks map[string]config.NetworkConfig
+	resolver RedemptionResolver
 }
 
+// SetupData is the url and codes to load into the pool of an offer, and Entries with their own url or payload. The
+// stores load the Entries only, to which FulfillmentPersistence.SetupFulfillment adds the url and codes.
 type SetupData struct {
-	ContractAddress string   `json:"contract_address"`
-	OfferId         string   `json:"offer_id"`
-	Url             string   `json:"url"`
-	Codes           []string `json:"codes"`
+	ContractAddress string      `json:"contract_address"`
+	OfferId         string      `json:"offer_id"`
+	Url             string      `json:"url"`
+	Codes           []string    `json:"codes"`
+	Entries         []ImportRow `json:"entries,omitempty"`
+	IdempotencyKey  string      `json:"-"`
+	requestHash     string      // of the setup as requested, before duplicate codes are removed
+}
+
+// SetupResult is the outcome of a setup: the number of codes loaded, and the codes skipped as duplicates of a code
+// already in the pool, or earlier in the setup.
+type SetupResult struct {
+	Loaded     int      `json:"loaded"`
+	Duplicates []string `json:"duplicates"`
+	Replayed   bool     `json:"-"` // the result of an earlier setup with the same idempotency key
 }
 
 type RedemptionTransaction struct {
@@ -59,287 +111,145 @@ type FulfillmentResponse struct {
 
 	Url  string `json:"url"`
 	Code string `json:"code"`
+
+	// Data is arbitrary fulfillment data, delivered instead of Url + Code when set: the payload loaded with the code,
+	// or from a custom fulfiller
+	Data interface{} `json:"data,omitempty"`
 }
 
-func NewFulfillmentPersistence(cm *db.ConnectionManager, ethUrls map[string]string) *FulfillmentPersistence {
-	log.Info("init FulfillmentPersistence", "cm", cm)
-	return &FulfillmentPersistence{pool: cm, ethUrlByNetwork: ethUrls}
+func NewFulfillmentPersistence(store Store, chain eth.Backends, networks map[string]config.NetworkConfig,
+	resolver RedemptionResolver) *FulfillmentPersistence {
+	log.Info("init FulfillmentPersistence", "store", fmt.Sprintf("%T", store), "resolver", fmt.Sprintf("%T", resolver))
+	return &FulfillmentPersistence{store: store, chain: chain, networks: networks, resolver: resolver}
 }
 
 func (fp *FulfillmentPersistence) AvailableNetworks() (nets []string) {
-	nets = utils.Keys(fp.ethUrlByNetwork)
+	nets = fp.chain.Networks()
 	return
 }
-func (fp *FulfillmentPersistence) SetupFulfillment(setup SetupData) (err error) {
-	log.Debug("SetupFulfillment", "setup", setup)
-	if setup.ContractAddress == "" || setup.OfferId == "" || setup.Url == "" || setup.Codes == nil || len(setup.Codes) == 0 {
-		log.Debug("invalid setup", "setup", setup)
-		err = errors.NoTrace("invalid load setup", errors.K.Invalid, "setup", setup)
-		return
-	}
-
-	for _, code := range setup.Codes {
-		var stmt string
-		if stmt, err = mergeTemplate("sql/add-mapping.tmpl", fp.context()); err != nil {
-			return
-		}
-
-		var args []interface{}
-		args = append(args, setup.ContractAddress)
-		args = append(args, setup.OfferId)
-		args = append(args, setup.Url)
-		args = append(args, code)
-
-		if _, err = fp.conn().Exec(stmt, args...); err != nil {
-			return
-		}
-	}
 
-	return
+func (fp *FulfillmentPersistence) NetworkState(network string) string {
+	return fp.chain.State(network)
 }
 
-func (fp *FulfillmentPersistence) FulfillRedeemableOffer(request FulfillmentRequest) (resp FulfillmentResponse, err error) {
-
-	var tx RedemptionTransaction
-	if tx, err = fp.resolveTransaction(request); err != nil {
-		log.Warn("error resolving tx", "error", err)
-		err = errors.NoTrace("error resolving tx", errors.K.Invalid, "error", err, "request", request)
-		return
+// SetupFulfillment loads the url and codes of `setup`, and its Entries, into the pool, all or nothing, skipping
+// duplicate codes. An entry without a url gets the url of the setup, and needs none with a payload.
+func (fp *FulfillmentPersistence) SetupFulfillment(setup SetupData) (result SetupResult, err error) {
+	log.Debug("SetupFulfillment", "setup", setup)
+	setup.ContractAddress = strings.ToLower(setup.ContractAddress)
+	entries := make([]ImportRow, 0, len(setup.Entries))
+	for _, entry := range setup.Entries {
+		if string(entry.Metadata) == "null" {
+			entry.Metadata = nil
+		}
+		if string(entry.Payload) == "null" {
+			entry.Payload = nil
+		}
+		entries = append(entries, entry)
 	}
-	offerId := fmt.Sprintf("%d", tx.OfferId)
-	tokenId := fmt.Sprintf("%d", tx.TokenId)
-	log.Debug("FulfillRedeemableOffer", "request", fmt.Sprintf("%+v", request), "tx", fmt.Sprintf("%+v", tx), "offerId", offerId, "tokenId", tokenId)
-
-	if request.UserAddress != tx.RedeemerAddress {
-		err = errors.NoTrace("mismatched user address", errors.K.Invalid, "request", request, "tx", tx)
+	setup.Entries = entries
+	if reason := invalidSetup(setup); reason != "" {
+		log.Debug("invalid setup", "setup", setup, "reason", reason)
+		err = errors.NoTrace("invalid load setup", errors.K.Invalid, "reason", reason, "setup", setup)
 		return
 	}
 
-	resp, err = fp.GetRedeemedOffer(tx.ContractAddress, offerId, tokenId)
-	if err != nil {
-		return
-	}
-	if resp.Claimed {
-		err = errors.NoTrace("token already claimed", errors.K.Invalid, "request", request, "tx", tx)
-		return
+	h := sha256.New()
+	for _, field := range append([]string{setup.ContractAddress, setup.OfferId, setup.Url}, setup.Codes...) {
+		_, _ = fmt.Fprintf(h, "%d:%s", len(field), field)
 	}
-
-	var stmt string
-	templateArgs := fp.context()
-	if stmt, err = mergeTemplate("sql/update-mapping.tmpl", templateArgs); err != nil {
-		return
+	for _, entry := range setup.Entries {
+		for _, field := range []string{entry.Url, entry.Code, string(entry.Metadata), string(entry.Payload)} {
+			_, _ = fmt.Fprintf(h, "%d:%s", len(field), field)
+		}
 	}
+	setup.requestHash = hex.EncodeToString(h.Sum(nil))
 
-	var args []interface{}
-	args = append(args, tokenId)
-	args = append(args, tx.RedeemerAddress)
-	args = append(args, tx.ContractAddress)
-	args = append(args, offerId)
-	//log.Trace("FulfillRedeemableOffer", "stmt", stmt, "args", args)
-
-	var rows *pgx.Rows
-	if rows, err = fp.conn().Query(stmt, args...); err != nil {
-		return
+	rows := make([]ImportRow, 0, len(setup.Codes)+len(setup.Entries))
+	for _, code := range setup.Codes {
+		rows = append(rows, ImportRow{Url: setup.Url, Code: code})
 	}
-	defer rows.Close()
-
-	if rows.Next() {
-		// fulfillment successful
-		resp, err = scanFulfillmentData(rows, tx.ContractAddress, offerId, tokenId)
-		if resp.Claimed {
-			resp.UserAddr = tx.RedeemerAddress
-
-			err = fp.markUrlAndCodeClaimed(resp.Url, resp.Code)
-			if err != nil {
-				return
-			}
+	for _, entry := range setup.Entries {
+		if entry.Url == "" {
+			entry.Url = setup.Url
 		}
-	} else {
-		// fulfillment failed; see why
-		var unclaimed []string
-		unclaimed, err = fp.GetUnclaimed(tx.ContractAddress, offerId)
-		if err != nil {
-			return
+		rows = append(rows, entry)
+	}
+
+	// the codes repeated in the setup are the same for a replay of the same setup
+	setup.Codes = nil
+	setup.Entries = make([]ImportRow, 0, len(rows))
+	repeated := make([]string, 0)
+	seen := make(map[string]struct{}, len(rows))
+	for _, row := range rows {
+		if _, ok := seen[row.Code]; ok {
+			repeated = append(repeated, row.Code)
+			continue
 		}
-
-		if len(unclaimed) == 0 {
-			err = errors.NoTrace("no more redemption codes available", errors.K.NotFound, "request", request, "tx", tx)
-		} else {
-			err = errors.NoTrace("unable to redeem", errors.K.Invalid, "request", request, "tx", tx)
-		}
-	}
-
-	return
-}
-
-// markUrlAndCodeClaimed marks the url and code as claimed in all other contracts, in case there are dups
-func (fp *FulfillmentPersistence) markUrlAndCodeClaimed(url, code string) (err error) {
-	var stmt string
-	templateArgs := fp.context()
-	if stmt, err = mergeTemplate("sql/mark-url-and-code-claimed.tmpl", templateArgs); err != nil {
-		return
-	}
-
-	var args []interface{}
-	args = append(args, url)
-	args = append(args, code)
-
-	var rows *pgx.Rows
-	if rows, err = fp.conn().Query(stmt, args...); err != nil {
-		return
-	}
-	defer rows.Close()
-
-	var otherContracts []string
-	otherContracts, err = scanDups(rows)
-	if err != nil {
-		return
-	}
-	if len(otherContracts) > 1 {
-		log.Debug("marked this Url and Code claimed", "otherContracts", otherContracts)
-	}
-
-	return
-}
-
-func (fp *FulfillmentPersistence) GetRedeemedOffer(contractAddr, redeemableId, tokenId string) (resp FulfillmentResponse, err error) {
-	var stmt string
-	templateArgs := fp.context()
-	if stmt, err = mergeTemplate("sql/get-mapping.tmpl", templateArgs); err != nil {
-		return
+		seen[row.Code] = struct{}{}
+		setup.Entries = append(setup.Entries, row)
 	}
 
-	var args []interface{}
-	args = append(args, contractAddr)
-	args = append(args, redeemableId)
-	args = append(args, tokenId)
-	//log.Trace("GetRedeemedOffer", "stmt", stmt, "args", args)
-
-	var rows *pgx.Rows
-	if rows, err = fp.conn().Query(stmt, args...); err != nil {
+	if result, err = fp.store.SetupFulfillment(setup); err != nil {
 		return
 	}
-	defer rows.Close()
-
-	if rows.Next() {
-		resp, err = scanFulfillmentData(rows, contractAddr, redeemableId, tokenId)
-	}
+	result.Duplicates = append(result.Duplicates, repeated...)
 
 	return
 }
 
-func (fp *FulfillmentPersistence) GetUnclaimed(contractAddr, redeemableId string) (unclaimed []string, err error) {
-	log.Debug("GetUnclaimed", "contractAddr", contractAddr, "redeemableId", redeemableId)
-	var stmt string
-	templateArgs := fp.context()
-	if stmt, err = mergeTemplate("sql/get-unclaimed.tmpl", templateArgs); err != nil {
-		return
+// invalidSetup returns the reason `setup` is invalid, or ""
+func invalidSetup(setup SetupData) string {
+	switch {
+	case setup.ContractAddress == "" || setup.OfferId == "":
+		return "missing contract address or offer id"
+	case len(setup.Codes) == 0 && len(setup.Entries) == 0:
+		return "no codes"
+	case len(setup.Codes) > 0 && setup.Url == "":
+		return "missing url"
 	}
-
-	var args []interface{}
-	args = append(args, contractAddr)
-	args = append(args, redeemableId)
-
-	var rows *pgx.Rows
-	if rows, err = fp.conn().Query(stmt, args...); err != nil {
-		return
-	}
-	defer rows.Close()
-
-	unclaimed = make([]string, 0)
-	for rows.Next() {
-		var url, code sql.NullString
-		if err = rows.Scan(&url, &code); err != nil {
-			return
+	for _, entry := range setup.Entries {
+		if entry.Code == "" {
+			return "entry without a code"
 		}
-		if code.Valid {
-			unclaimed = append(unclaimed, code.String)
+		if entry.Url == "" && setup.Url == "" && len(entry.Payload) == 0 {
+			return "entry without a url or payload"
 		}
-	}
-
-	return
-}
-
-func scanFulfillmentData(rows *pgx.Rows, contractAddr, redeemableId, tokenId string) (row FulfillmentResponse, err error) {
-	var claimed sql.NullBool
-	var addr, url, code sql.NullString
-	var created, updated sql.NullTime
-	if err = rows.Scan(&claimed, &addr, &url, &code, &created, &updated); err != nil {
-		return
-	}
-	if claimed.Valid {
-		row = FulfillmentResponse{
-			Claimed:  claimed.Bool,
-			UserAddr: addr.String,
-			Created:  created.Time,
-			Updated:  updated.Time,
-			Url:      url.String,
-			Code:     code.String,
-
-			ContractAddr: contractAddr,
-			OfferId:      redeemableId,
-			TokenId:      tokenId,
+		if len(entry.Metadata) > 0 && !isJSONObject(entry.Metadata) {
+			return "entry metadata is not a json object"
 		}
 	}
-
-	return
+	return ""
 }
 
-func scanDups(rows *pgx.Rows) (otherContracts []string, err error) {
-	otherContracts = make([]string, 0)
-
-	for rows.Next() {
-		var addr sql.NullString
-		if err = rows.Scan(&addr); err != nil {
-			return
-		}
-		if addr.Valid {
-			otherContracts = append(otherContracts, addr.String)
-		}
-	}
-
-	return
+// ClaimCode claims an unclaimed url and code of the contract and offer in the verified redemption `tx` for its token.
+func (fp *FulfillmentPersistence) ClaimCode(tx RedemptionTransaction) (resp FulfillmentResponse, err error) {
+	return fp.store.ClaimCode(tx)
 }
 
-func (fd *FulfillmentResponse) ToTransaction() RedemptionTransaction {
-	tid, _ := strconv.ParseInt(fd.TokenId, 10, 64)
-	var oid uint8
-	_, _ = fmt.Scan(fd.OfferId, &oid)
-	return RedemptionTransaction{
-		RedeemerAddress: fd.UserAddr,
-		ContractAddress: fd.ContractAddr,
-		TokenId:         tid,
-		OfferId:         oid,
-	}
+func (fp *FulfillmentPersistence) GetRedeemedOffer(contractAddr, redeemableId, tokenId string) (resp FulfillmentResponse, err error) {
+	return fp.store.GetRedeemedOffer(strings.ToLower(contractAddr), redeemableId, tokenId)
 }
 
-var whitespace = regexp.MustCompile(`\s+`)
-
-func mergeTemplate(path string, ctx map[string]interface{}) (stmt string, err error) {
-	var b []byte
-	if b, err = fs.ReadFile(statementsFS, path); err != nil {
-		return
-	}
-
-	var t *template.Template
-	if t, err = template.New(path).Parse(string(b)); err != nil {
-		return
-	}
-	buf := new(bytes.Buffer)
-	if err = t.Execute(buf, ctx); err != nil {
-		return
-	}
-
-	stmt = whitespace.ReplaceAllString(buf.String(), " ")
-	return
+func (fp *FulfillmentPersistence) GetUnclaimed(contractAddr, redeemableId string) (unclaimed []string, err error) {
+	return fp.store.GetUnclaimed(strings.ToLower(contractAddr), redeemableId)
 }
 
-func (fp *FulfillmentPersistence) conn() *pgx.ConnPool {
-	return fp.pool.GetConn()
+// OfferAndTokenIds returns the offer and token ids as stored with a claim
+func (rt RedemptionTransaction) OfferAndTokenIds() (offerId, tokenId string) {
+	return fmt.Sprintf("%d", rt.OfferId), fmt.Sprintf("%d", rt.TokenId)
 }
 
-func (fp *FulfillmentPersistence) context() map[string]interface{} {
-	return map[string]interface{}{
-		"database": "fulfillmentservice",
+// FulfillmentData returns the data delivered to the user: Data, verbatim, or else the url and code.
+func (fd *FulfillmentResponse) FulfillmentData() interface{} {
+	if fd.Data != nil {
+		return fd.Data
+	}
+	return struct {
+		Url  string `json:"url"`
+		Code string `json:"code"`
+	}{
+		Url:  fd.Url,
+		Code: fd.Code,
 	}
 }
@@ -3,54 +3,76 @@ package db
 import (
 	"context"
 	"fmt"
+	"fulfillmentd/server/config"
+	"fulfillmentd/server/eth"
+	"fulfillmentd/utils"
 	"github.com/eluv-io/contracts/contracts-go/tradable"
 	"github.com/eluv-io/errors-go"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
+	"math/big"
+	"regexp"
 	"strings"
+	"time"
 )
 
-// ToRedemptionTransaction converts based on https://gist.github.com/elv-preethi/44e0a809d3e7daa4e7713d6b23ead136
-func (fp *FulfillmentPersistence) ToRedemptionTransaction(fr FulfillmentRequest) (redemption RedemptionTransaction, err error) {
-	// get data from tx
-	log.Debug("using eth network", "network", fr.Network)
-	var ec *ethclient.Client
-	ec, err = ethclient.Dial(fp.ethUrlByNetwork[fr.Network])
-	if err != nil {
-		return
-	}
-	defer ec.Close()
+// txHashRegex matches a transaction id: a 32-byte hash in hex
+var txHashRegex = regexp.MustCompile(`^0x[0-9a-fA-F]{64}$`)
 
-	var receipt *types.Receipt
-	receipt, err = ec.TransactionReceipt(context.Background(), common.HexToHash(fr.Transaction))
+// redeemEvent is the ElvTradable Redeem event, matched by its topic in receipt logs
+var redeemEvent = mustRedeemEvent()
+
+func mustRedeemEvent() abi.Event {
+	parsed, err := tradable.ElvTradableMetaData.GetAbi()
 	if err != nil {
-		return
+		panic(err)
 	}
+	return parsed.Events["Redeem"]
+}
 
-	var tr *tradable.ElvTradableRedeem
-	if len(receipt.Logs) > 0 {
-		var instance *tradable.ElvTradable
-		instance, err = tradable.NewElvTradable(receipt.Logs[0].Address, ec)
-		if err != nil {
-			return
-		}
+// RedemptionResolver resolves the redemptions made in a transaction.
+type RedemptionResolver interface {
+	ResolveTransaction(request FulfillmentRequest) ([]RedemptionTransaction, error)
+}
 
-		tr, err = instance.ParseRedeem(*receipt.Logs[0])
-		if err != nil {
-			return
-		}
-	} else {
-		err = errors.NoTrace("no logs found in receipt", errors.K.Invalid, "receipt", receipt)
+// EthResolver resolves the redemptions in a transaction from the Redeem events of its receipt on chain.
+type EthResolver struct {
+	chain    eth.Backends
+	networks map[string]config.NetworkConfig
+}
+
+func NewEthResolver(chain eth.Backends, networks map[string]config.NetworkConfig) *EthResolver {
+	return &EthResolver{chain: chain, networks: networks}
+}
+
+// ResolveTransaction does an external query to the ELV blockchain to resolve the redemptions in the request
+// transaction.
+func (r *EthResolver) ResolveTransaction(request FulfillmentRequest) (rts []RedemptionTransaction, err error) {
+	if !txHashRegex.MatchString(request.Transaction) {
+		err = errors.NoTrace("invalid transaction id", errors.K.Invalid, "tx", request.Transaction)
 		return
 	}
 
-	contractAddress := receipt.Logs[0].Address.String()
-	hash := common.BytesToHash(common.FromHex(fr.Transaction))
+	log.Debug("using eth network", "network", request.Network)
+	err = r.chain.Do(request.Network, func(ctx context.Context, backend eth.Backend) (err error) {
+		rts, err = r.toRedemptionTransactions(ctx, backend, request)
+		return
+	})
+
+	return
+}
+
+// toRedemptionTransactions converts based on https://gist.github.com/elv-preethi/44e0a809d3e7daa4e7713d6b23ead136
+// It returns a redemption for every Redeem event in the receipt logs, in log order, skipping events from contracts
+// that are not in the network's redeem_contracts (if any are configured).
+func (r *EthResolver) toRedemptionTransactions(ctx context.Context, backend eth.Backend,
+	fr FulfillmentRequest) (redemptions []RedemptionTransaction, err error) {
+	hash := common.HexToHash(fr.Transaction)
 	var isPending bool
-	_, isPending, err = ec.TransactionByHash(context.Background(), hash)
-	if err != nil {
-		err = errors.NoTrace("cannot find tx", "err", err)
+	if _, isPending, err = backend.TransactionByHash(ctx, hash); err != nil {
+		err = errors.NoTrace("cannot find tx", err)
 		return
 	}
 	if isPending {
@@ -58,71 +80,174 @@ func (fp *FulfillmentPersistence) ToRedemptionTransaction(fr FulfillmentRequest)
 		return
 	}
 
-	redemption = RedemptionTransaction{
-		ContractAddress: strings.ToLower(contractAddress),
-		RedeemerAddress: strings.ToLower(tr.Redeemer.String()),
-		TokenId:         tr.TokenId.Int64(),
-		OfferId:         tr.OfferId,
-		IsPending:       isPending,
+	var receipt *types.Receipt
+	if receipt, err = backend.TransactionReceipt(ctx, hash); err != nil {
+		return
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		err = errors.NoTrace("tx reverted", errors.K.Invalid, "tx", fr.Transaction, "status", receipt.Status)
+		return
+	}
+	if len(receipt.Logs) == 0 {
+		err = errors.NoTrace("no logs found in receipt", errors.K.Invalid, "receipt", receipt)
+		return
+	}
+	if err = r.checkConfirmations(ctx, backend, fr.Network, receipt); err != nil {
+		return
+	}
+
+	var filterer *tradable.ElvTradableFilterer
+	if filterer, err = tradable.NewElvTradableFilterer(common.Address{}, nil); err != nil {
+		return
+	}
+
+	allowed := r.networks[fr.Network].RedeemContracts
+	redemptions = make([]RedemptionTransaction, 0)
+	for _, l := range receipt.Logs {
+		if l.Removed || len(l.Topics) == 0 || l.Topics[0] != redeemEvent.ID {
+			continue
+		}
+		contractAddress := strings.ToLower(l.Address.String())
+		if len(allowed) > 0 && !utils.ArrayContains(allowed, contractAddress) {
+			log.Debug("ignoring Redeem event from contract not in redeem_contracts", "contract", contractAddress,
+				"network", fr.Network)
+			continue
+		}
+
+		var tr *tradable.ElvTradableRedeem
+		if tr, err = filterer.ParseRedeem(*l); err != nil {
+			err = errors.NoTrace("cannot parse Redeem event", errors.K.Invalid, err, "log_index", l.Index)
+			return
+		}
+		redemptions = append(redemptions, RedemptionTransaction{
+			ContractAddress: contractAddress,
+			RedeemerAddress: strings.ToLower(tr.Redeemer.String()),
+			TokenId:         tr.TokenId.Int64(),
+			OfferId:         tr.OfferId,
+		})
+	}
+	if len(redemptions) == 0 {
+		err = errors.NoTrace("no Redeem event found in receipt", errors.K.Invalid, "tx", fr.Transaction,
+			"network", fr.Network)
+		return
 	}
-	log.Debug("ToRedemptionTransaction", "redemption", fmt.Sprintf("%+v", redemption))
+	log.Debug("ToRedemptionTransactions", "redemptions", fmt.Sprintf("%+v", redemptions))
 
 	return
 }
 
-// resolveTransaction does an external query to the ELV blockchain to resolve the data from in the request transaction.
-// It also provides mock data for testing from `make load_codes` + `make fulfill_code`
-func (fp *FulfillmentPersistence) resolveTransaction(request FulfillmentRequest) (rt RedemptionTransaction, err error) {
-	var isTestData bool
-	isTestData, rt = fp.fillTestData(request)
-	if isTestData {
-		log.Warn("resolveTransaction", "isTestData", isTestData, "redemption", fmt.Sprintf("%+v", rt))
+// NotFinalError is returned for a transaction with fewer confirmations than the network's min_confirmations, since its
+// block may still be reorganized out of the chain.
+type NotFinalError struct {
+	Confirmations    uint64
+	MinConfirmations uint64
+	BlockTime        time.Duration
+}
+
+func (e *NotFinalError) Error() string {
+	return fmt.Sprintf("tx not yet final: %d of %d confirmations, retry after %d blocks",
+		e.Confirmations, e.MinConfirmations, e.RetryAfterBlocks())
+}
+
+// RetryAfterBlocks returns the number of blocks until the transaction is final.
+func (e *NotFinalError) RetryAfterBlocks() uint64 {
+	return e.MinConfirmations - e.Confirmations
+}
+
+// RetryAfter returns the expected time until the transaction is final.
+func (e *NotFinalError) RetryAfter() time.Duration {
+	return time.Duration(e.RetryAfterBlocks()) * e.BlockTime
+}
+
+// checkConfirmations returns a NotFinalError if the block of `receipt` is not yet min_confirmations deep in the chain.
+func (r *EthResolver) checkConfirmations(ctx context.Context, backend eth.Backend, network string,
+	receipt *types.Receipt) (err error) {
+	netCfg := r.networks[network]
+	if netCfg.MinConfirmations <= 1 {
+		// mined is final enough
 		return
 	}
 
-	rt, err = fp.ToRedemptionTransaction(request)
-	if err != nil {
+	var head uint64
+	if head, err = backend.BlockNumber(ctx); err != nil {
+		err = errors.NoTrace("cannot get chain head", errors.K.Unavailable, err, "network", network)
 		return
 	}
 
+	var confirmations uint64
+	if txBlock := receipt.BlockNumber.Uint64(); head >= txBlock {
+		confirmations = head - txBlock + 1
+	}
+	log.Debug("checkConfirmations", "confirmations", confirmations, "min_confirmations", netCfg.MinConfirmations)
+	if confirmations < netCfg.MinConfirmations {
+		err = &NotFinalError{
+			Confirmations:    confirmations,
+			MinConfirmations: netCfg.MinConfirmations,
+			BlockTime:        netCfg.BlockTime,
+		}
+	}
+
 	return
 }
 
-// fillTestData is for integration testing. It provides mock data for testing from `make load_codes` + `make fulfill_code`
-func (fp *FulfillmentPersistence) fillTestData(request FulfillmentRequest) (isTestData bool, redeemable RedemptionTransaction) {
-	isTestData = false
-	if strings.Contains(request.Transaction, "tx-test") {
-		isTestData = true
-		testTx := request.Transaction
+// ContractOwner returns the on-chain owner of the contract at `contractAddr` on `network`.
+func (fp *FulfillmentPersistence) ContractOwner(network, contractAddr string) (owner string, err error) {
+	err = fp.chain.Do(network, func(ctx context.Context, backend eth.Backend) (err error) {
+		var instance *tradable.ElvTradableCaller
+		if instance, err = tradable.NewElvTradableCaller(common.HexToAddress(contractAddr), backend); err != nil {
+			return
+		}
 
-		request.Transaction = "0x6ba5f67b3c477422260808f3120a6b2efec9453d167661c171a3501e65f9d29d"
-		log.Warn("converting tx-test to tx", "tx", request.Transaction)
+		var addr common.Address
+		if addr, err = instance.Owner(&bind.CallOpts{Context: ctx}); err != nil {
+			return
+		}
+		owner = strings.ToLower(addr.Hex())
+
+		return
+	})
+
+	return
+}
 
-		var err error
-		redeemable, err = fp.ToRedemptionTransaction(request)
-		if err != nil {
-			log.Error("cannot convert tx-test to tx", "err", err)
+// VerifyOwnership checks on chain that the token of `tx` is still owned by its redeemer, and that its offer is still
+// marked redeemed, so that a token transferred since its redemption cannot be fulfilled by its former owner.
+func (fp *FulfillmentPersistence) VerifyOwnership(network string, tx RedemptionTransaction) (err error) {
+	tokenId := big.NewInt(tx.TokenId)
+	err = fp.chain.Do(network, func(ctx context.Context, backend eth.Backend) (err error) {
+		var instance *tradable.ElvTradableCaller
+		if instance, err = tradable.NewElvTradableCaller(common.HexToAddress(tx.ContractAddress), backend); err != nil {
 			return
 		}
+		opts := &bind.CallOpts{Context: ctx}
 
-		switch testTx {
-		case "tx-test-0000":
-			redeemable.RedeemerAddress = request.UserAddress
-			redeemable.TokenId = 1
-		case "tx-test-0001":
-			redeemable.RedeemerAddress = request.UserAddress
-			redeemable.TokenId = 2
-		case "tx-test-0002":
-			redeemable.RedeemerAddress = request.UserAddress
-			redeemable.TokenId = 3
-		case "tx-test-invaliduser":
-			// already invalid
+		var owner common.Address
+		if owner, err = instance.OwnerOf(opts, tokenId); err != nil {
+			err = errors.NoTrace("cannot get token owner", errors.K.Invalid, err, "tx", tx)
+			return
+		}
+		if !strings.EqualFold(owner.Hex(), tx.RedeemerAddress) {
+			err = errors.NoTrace("token no longer owned by redeemer", errors.K.Permission, "tx", tx,
+				"owner", strings.ToLower(owner.Hex()))
+			return
 		}
-	}
 
-	if isTestData {
-		log.Warn("forged redemption redeemable", "redemption", redeemable)
-	}
+		var redeemed bool
+		if redeemed, err = instance.IsOfferRedeemed(opts, tokenId, tx.OfferId); err != nil {
+			err = errors.NoTrace("cannot get offer redemption", errors.K.Invalid, err, "tx", tx)
+			return
+		}
+		if !redeemed {
+			err = errors.NoTrace("offer not redeemed on chain", errors.K.Permission, "tx", tx)
+		}
+
+		return
+	})
 
 	return
 }
+
+// ResolveTransaction resolves the redemptions in the request transaction, on chain or from the simulation fixtures.
+func (fp *FulfillmentPersistence) ResolveTransaction(request FulfillmentRequest) (rts []RedemptionTransaction, err error) {
+	return fp.resolver.ResolveTransaction(request)
+}
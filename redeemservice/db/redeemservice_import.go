@@ -0,0 +1,306 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/eluv-io/errors-go"
+	"io"
+	"path"
+	"strings"
+)
+
+// import formats
+const (
+	ImportCSV   = "csv"
+	ImportJSONL = "jsonl"
+)
+
+const (
+	// importBatchSize is the number of rows inserted per statement
+	importBatchSize = 1000
+
+	// maxReportedRows caps the rejected rows and duplicate codes listed in an ImportSummary
+	maxReportedRows = 100
+
+	// maxJSONLLine is the longest line of a JSONL import
+	maxJSONLLine = 1024 * 1024
+)
+
+// ImportRow is a url and code to add to the pool of an offer, with optional metadata kept alongside for the admins.
+// A row with a payload, any JSON value, delivers the payload instead of its url and code, and needs no url.
+type ImportRow struct {
+	Url      string          `json:"url"`
+	Code     string          `json:"code"`
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+}
+
+// ImportSummary counts the rows of an import: each is inserted, skipped as a duplicate of a code already in the pool
+// or earlier in the import, or rejected as invalid.
+type ImportSummary struct {
+	Rows           int           `json:"rows"`
+	Inserted       int           `json:"inserted"`
+	Duplicates     int           `json:"duplicates"`
+	Rejected       int           `json:"rejected"`
+	DuplicateCodes []string      `json:"duplicate_codes,omitempty"` // the first maxReportedRows
+	RejectedRows   []RejectedRow `json:"rejected_rows,omitempty"`   // the first maxReportedRows
+}
+
+// RejectedRow is an invalid row of an import, by line number from 1.
+type RejectedRow struct {
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+// ImportCodes streams the rows of `r`, in the ImportCSV or ImportJSONL `format`, into the pool of the contract and
+// offer, in batches of importBatchSize rows. Rows without a url get `defaultUrl`.
+//
+// A CSV import starts with a header row naming its columns: `code`, and optionally `url`, `metadata` (a JSON
+// object) and `payload` (JSON); other columns are added to the metadata as strings. A JSONL import has an ImportRow object per line.
+//
+// Invalid rows are rejected and the import goes on; err is only returned if `r` cannot be read as `format`, or if a
+// batch cannot be stored, with the summary of the batches stored before.
+func (fp *FulfillmentPersistence) ImportCodes(contractAddr, offerId, defaultUrl, format string,
+	r io.Reader) (summary ImportSummary, err error) {
+	contractAddr = strings.ToLower(contractAddr)
+	if contractAddr == "" || offerId == "" {
+		err = errors.NoTrace("invalid import", errors.K.Invalid, "reason", "missing contract address or offer id")
+		return
+	}
+
+	imp := &importer{
+		fp:           fp,
+		contractAddr: contractAddr,
+		offerId:      offerId,
+		defaultUrl:   defaultUrl,
+		seen:         make(map[string]struct{}),
+		summary:      &summary,
+	}
+	switch format {
+	case ImportCSV:
+		err = imp.readCSV(r)
+	case ImportJSONL:
+		err = imp.readJSONL(r)
+	default:
+		err = errors.NoTrace("invalid import", errors.K.Invalid, "reason", "unknown format", "format", format)
+	}
+	if err == nil {
+		err = imp.flush()
+	}
+	log.Info("ImportCodes", "contract_addr", contractAddr, "offer_id", offerId, "rows", summary.Rows,
+		"inserted", summary.Inserted, "duplicates", summary.Duplicates, "rejected", summary.Rejected, "err", err)
+
+	return
+}
+
+// ImportFormatOf returns the import format of a file by its extension: ImportCSV for .csv, ImportJSONL for .jsonl or
+// .ndjson, or "" if unknown.
+func ImportFormatOf(fileName string) string {
+	switch strings.ToLower(path.Ext(fileName)) {
+	case ".csv":
+		return ImportCSV
+	case ".jsonl", ".ndjson":
+		return ImportJSONL
+	}
+	return ""
+}
+
+// importer accumulates the valid rows of an import into batches
+type importer struct {
+	fp           *FulfillmentPersistence
+	contractAddr string
+	offerId      string
+	defaultUrl   string
+	seen         map[string]struct{} // codes of the import so far
+	batch        []ImportRow
+	summary      *ImportSummary
+}
+
+func (imp *importer) readCSV(r io.Reader) (err error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	var header []string
+	if header, err = reader.Read(); err != nil {
+		err = errors.NoTrace("invalid import", errors.K.Invalid, err, "reason", "cannot read csv header")
+		return
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["code"]; !ok {
+		err = errors.NoTrace("invalid import", errors.K.Invalid, "reason", "no code column in csv header",
+			"header", header)
+		return
+	}
+
+	for {
+		record, readErr := reader.Read()
+		if readErr == io.EOF {
+			return
+		}
+		if readErr != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(readErr, &parseErr) {
+				return errors.NoTrace("invalid import", errors.K.Invalid, readErr, "reason", "cannot read csv")
+			}
+			imp.reject(parseErr.Line, readErr.Error())
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+
+		row, rowErr := csvRow(header, record)
+		if rowErr != "" {
+			imp.reject(line, rowErr)
+			continue
+		}
+		if err = imp.add(line, row); err != nil {
+			return
+		}
+	}
+}
+
+// csvRow returns the ImportRow of a csv record, or the reason it is invalid
+func csvRow(header []string, record []string) (row ImportRow, reason string) {
+	metadata := make(map[string]interface{})
+	for i, value := range record {
+		switch name := strings.ToLower(strings.TrimSpace(header[i])); name {
+		case "code":
+			row.Code = value
+		case "url":
+			row.Url = value
+		case "metadata":
+			var obj map[string]interface{}
+			if value != "" && json.Unmarshal([]byte(value), &obj) != nil {
+				return row, "metadata is not a json object"
+			}
+			for k, v := range obj {
+				metadata[k] = v
+			}
+		case "payload":
+			if value != "" && value != "null" {
+				if !json.Valid([]byte(value)) {
+					return row, "payload is not json"
+				}
+				row.Payload = json.RawMessage(value)
+			}
+		default:
+			if value != "" {
+				metadata[header[i]] = value
+			}
+		}
+	}
+
+	if len(metadata) > 0 {
+		row.Metadata, _ = json.Marshal(metadata)
+	}
+	return
+}
+
+func (imp *importer) readJSONL(r io.Reader) (err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxJSONLLine)
+
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+
+		var row ImportRow
+		if jsonErr := json.Unmarshal(data, &row); jsonErr != nil {
+			imp.reject(line, "invalid json: "+jsonErr.Error())
+			continue
+		}
+		if string(row.Metadata) == "null" {
+			row.Metadata = nil
+		}
+		if string(row.Payload) == "null" {
+			row.Payload = nil
+		}
+		if len(row.Metadata) > 0 && !isJSONObject(row.Metadata) {
+			imp.reject(line, "metadata is not a json object")
+			continue
+		}
+		if err = imp.add(line, row); err != nil {
+			return
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		err = errors.NoTrace("invalid import", errors.K.Invalid, err, "reason", "cannot read jsonl")
+	}
+
+	return
+}
+
+// add validates `row` and adds it to the batch, storing the batch when full
+func (imp *importer) add(line int, row ImportRow) (err error) {
+	row.Code = strings.TrimSpace(row.Code)
+	row.Url = strings.TrimSpace(row.Url)
+	if row.Url == "" {
+		row.Url = imp.defaultUrl
+	}
+	if row.Code == "" {
+		imp.reject(line, "missing code")
+		return
+	}
+	if row.Url == "" && len(row.Payload) == 0 {
+		imp.reject(line, "missing url")
+		return
+	}
+
+	imp.summary.Rows++
+	if _, ok := imp.seen[row.Code]; ok {
+		imp.duplicate(row.Code)
+		return
+	}
+	imp.seen[row.Code] = struct{}{}
+
+	imp.batch = append(imp.batch, row)
+	if len(imp.batch) >= importBatchSize {
+		err = imp.flush()
+	}
+	return
+}
+
+// flush stores the rows of the batch
+func (imp *importer) flush() (err error) {
+	if len(imp.batch) == 0 {
+		return
+	}
+
+	var duplicates []string
+	if duplicates, err = imp.fp.store.ImportCodes(imp.contractAddr, imp.offerId, imp.batch); err != nil {
+		return
+	}
+	imp.summary.Inserted += len(imp.batch) - len(duplicates)
+	for _, code := range duplicates {
+		imp.duplicate(code)
+	}
+
+	imp.batch = imp.batch[:0]
+	return
+}
+
+func (imp *importer) duplicate(code string) {
+	imp.summary.Duplicates++
+	if len(imp.summary.DuplicateCodes) < maxReportedRows {
+		imp.summary.DuplicateCodes = append(imp.summary.DuplicateCodes, code)
+	}
+}
+
+func (imp *importer) reject(line int, reason string) {
+	imp.summary.Rows++
+	imp.summary.Rejected++
+	if len(imp.summary.RejectedRows) < maxReportedRows {
+		imp.summary.RejectedRows = append(imp.summary.RejectedRows, RejectedRow{Line: line, Reason: reason})
+	}
+}
+
+func isJSONObject(data json.RawMessage) bool {
+	var obj map[string]interface{}
+	return json.Unmarshal(data, &obj) == nil
+}
@@ -0,0 +1,329 @@
+package db
+
+import (
+	"encoding/json"
+	"github.com/eluv-io/errors-go"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemStore is an in-memory Store with the same semantics as PgStore, for running and testing without a database.
+// Nothing is persisted across restarts.
+type MemStore struct {
+	mu           sync.Mutex
+	rows         []*memRow
+	offers       map[string]Offer          // by contract and offer id
+	loadRequests map[string]memLoadRequest // by idempotency key
+	alerts       map[string]struct{}       // fired, by contract, offer id and threshold
+}
+
+// memLoadRequest mirrors a load_requests table row
+type memLoadRequest struct {
+	requestHash string
+	result      SetupResult
+}
+
+// memRow mirrors a fulfillment_service table row
+type memRow struct {
+	contractAddr    string
+	redeemableId    string
+	url             string
+	code            string
+	metadata        json.RawMessage
+	payload         json.RawMessage
+	claimed         bool
+	claimerTokenId  string
+	claimerUserAddr string
+	created         time.Time
+	updated         time.Time
+}
+
+func NewMemStore() *MemStore {
+	log.Info("init MemStore")
+	return &MemStore{
+		rows:         make([]*memRow, 0),
+		offers:       make(map[string]Offer),
+		loadRequests: make(map[string]memLoadRequest),
+		alerts:       make(map[string]struct{}),
+	}
+}
+
+func (ms *MemStore) SetupFulfillment(setup SetupData) (result SetupResult, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if setup.IdempotencyKey != "" {
+		if req, ok := ms.loadRequests[setup.IdempotencyKey]; ok {
+			if req.requestHash != setup.requestHash {
+				err = errors.NoTrace("idempotency key reused for another load", errors.K.Exist,
+					"idempotency_key", setup.IdempotencyKey)
+				return
+			}
+			result = req.result
+			result.Duplicates = append([]string{}, req.result.Duplicates...)
+			result.Replayed = true
+			return
+		}
+	}
+
+	duplicates := ms.importCodes(setup.ContractAddress, setup.OfferId, setup.Entries)
+	result = SetupResult{Loaded: len(setup.Entries) - len(duplicates), Duplicates: duplicates}
+
+	if setup.IdempotencyKey != "" {
+		ms.loadRequests[setup.IdempotencyKey] = memLoadRequest{requestHash: setup.requestHash, result: result}
+		result.Duplicates = append([]string{}, duplicates...)
+	}
+
+	return
+}
+
+func (ms *MemStore) ImportCodes(contractAddr, offerId string, rows []ImportRow) (duplicates []string, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.importCodes(contractAddr, offerId, rows), nil
+}
+
+// importCodes adds the rows with a code not yet in the pool, and returns the others; ms.mu must be held
+func (ms *MemStore) importCodes(contractAddr, offerId string, rows []ImportRow) (duplicates []string) {
+	pooled := make(map[string]struct{})
+	for _, row := range ms.rows {
+		if row.contractAddr == contractAddr && row.redeemableId == offerId {
+			pooled[row.code] = struct{}{}
+		}
+	}
+
+	now := time.Now().UTC()
+	duplicates = make([]string, 0)
+	for _, row := range rows {
+		if _, ok := pooled[row.Code]; ok {
+			duplicates = append(duplicates, row.Code)
+			continue
+		}
+		ms.rows = append(ms.rows, &memRow{
+			contractAddr: contractAddr,
+			redeemableId: offerId,
+			url:          row.Url,
+			code:         row.Code,
+			metadata:     row.Metadata,
+			payload:      row.Payload,
+			created:      now,
+			updated:      now,
+		})
+		pooled[row.Code] = struct{}{}
+	}
+
+	return
+}
+
+func (ms *MemStore) ClaimCode(tx RedemptionTransaction) (resp FulfillmentResponse, err error) {
+	offerId, tokenId := tx.OfferAndTokenIds()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if row := ms.findClaim(tx.ContractAddress, offerId, tokenId); row != nil {
+		resp = row.toResponse()
+		err = errors.NoTrace("token already claimed", errors.K.Invalid, "tx", tx)
+		return
+	}
+
+	var claim *memRow
+	for _, row := range ms.rows {
+		if row.contractAddr == tx.ContractAddress && row.redeemableId == offerId && !row.claimed {
+			claim = row
+			break
+		}
+	}
+	if claim == nil {
+		err = errors.NoTrace("no more redemption codes available", errors.K.NotFound, "tx", tx)
+		return
+	}
+
+	now := time.Now().UTC()
+	claim.claimed = true
+	claim.claimerTokenId = tokenId
+	claim.claimerUserAddr = tx.RedeemerAddress
+	claim.updated = now
+
+	// mark the url and code as claimed in all other contracts, in case there are dups; a code with a payload and no
+	// url is not shared
+	for _, row := range ms.rows {
+		if claim.url != "" && row.url == claim.url && row.code == claim.code && !row.claimed {
+			row.claimed = true
+			row.updated = now
+		}
+	}
+
+	resp = claim.toResponse()
+	return
+}
+
+func (ms *MemStore) GetRedeemedOffer(contractAddr, redeemableId, tokenId string) (resp FulfillmentResponse, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if row := ms.findClaim(contractAddr, redeemableId, tokenId); row != nil {
+		resp = row.toResponse()
+	}
+	return
+}
+
+func (ms *MemStore) GetUnclaimed(contractAddr, redeemableId string) (unclaimed []string, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	unclaimed = make([]string, 0)
+	for _, row := range ms.rows {
+		if row.contractAddr == contractAddr && row.redeemableId == redeemableId && !row.claimed {
+			unclaimed = append(unclaimed, row.code)
+		}
+	}
+	return
+}
+
+func (ms *MemStore) GetStats(contractAddr, offerId string, since []time.Time) (stats []OfferStats, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	byOffer := make(map[string]*OfferStats)
+	for _, row := range ms.rows {
+		if row.contractAddr != contractAddr || (offerId != "" && row.redeemableId != offerId) {
+			continue
+		}
+		st, ok := byOffer[row.redeemableId]
+		if !ok {
+			st = &OfferStats{
+				ContractAddress: contractAddr,
+				OfferId:         row.redeemableId,
+				ClaimRates:      make([]ClaimRate, len(since)),
+			}
+			byOffer[row.redeemableId] = st
+		}
+
+		st.Total++
+		if !row.claimed {
+			st.Remaining++
+			continue
+		}
+		st.Claimed++
+		if row.claimerTokenId == "" {
+			continue
+		}
+		for i, t := range since {
+			if row.updated.After(t) {
+				st.ClaimRates[i].Claimed++
+			}
+		}
+		if updated := row.updated; st.FirstClaim == nil || updated.Before(*st.FirstClaim) {
+			st.FirstClaim = &updated
+		}
+		if updated := row.updated; st.LastClaim == nil || updated.After(*st.LastClaim) {
+			st.LastClaim = &updated
+		}
+	}
+
+	stats = make([]OfferStats, 0, len(byOffer))
+	for _, st := range byOffer {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].OfferId < stats[j].OfferId })
+
+	return
+}
+
+func (ms *MemStore) AddAlert(contractAddr, offerId, threshold string) (added bool, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	key := contractAddr + "/" + offerId + "/" + threshold
+	if _, ok := ms.alerts[key]; ok {
+		return
+	}
+	ms.alerts[key] = struct{}{}
+	return true, nil
+}
+
+func (ms *MemStore) DeleteAlert(contractAddr, offerId, threshold string) (err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.alerts, contractAddr+"/"+offerId+"/"+threshold)
+	return
+}
+
+func (ms *MemStore) PutOffer(offer Offer) (stored Offer, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	key := offer.ContractAddress + "/" + offer.OfferId
+	now := time.Now().UTC()
+	offer.Created, offer.Updated = now, now
+	if prev, ok := ms.offers[key]; ok {
+		offer.Created = prev.Created
+	}
+	ms.offers[key] = offer
+
+	return offer, nil
+}
+
+func (ms *MemStore) GetOffer(contractAddr, offerId string) (offer Offer, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	offer, ok := ms.offers[contractAddr+"/"+offerId]
+	if !ok {
+		err = errors.NoTrace("offer not registered", errors.K.NotExist, "contract_addr", contractAddr,
+			"offer_id", offerId)
+	}
+	return
+}
+
+func (ms *MemStore) ListOffers(contractAddr string) (offers []Offer, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	offers = make([]Offer, 0)
+	for _, offer := range ms.offers {
+		if contractAddr == "" || offer.ContractAddress == contractAddr {
+			offers = append(offers, offer)
+		}
+	}
+	sort.Slice(offers, func(i, j int) bool {
+		if offers[i].ContractAddress != offers[j].ContractAddress {
+			return offers[i].ContractAddress < offers[j].ContractAddress
+		}
+		return offers[i].OfferId < offers[j].OfferId
+	})
+	return
+}
+
+// findClaim returns the row claimed by the token, or nil; ms.mu must be held
+func (ms *MemStore) findClaim(contractAddr, redeemableId, tokenId string) *memRow {
+	for _, row := range ms.rows {
+		if row.contractAddr == contractAddr && row.redeemableId == redeemableId && row.claimerTokenId == tokenId {
+			return row
+		}
+	}
+	return nil
+}
+
+func (row *memRow) toResponse() (resp FulfillmentResponse) {
+	resp = FulfillmentResponse{
+		Claimed:  row.claimed,
+		UserAddr: row.claimerUserAddr,
+		Created:  row.created,
+		Updated:  row.updated,
+		Url:      row.url,
+		Code:     row.code,
+
+		ContractAddr: row.contractAddr,
+		OfferId:      row.redeemableId,
+		TokenId:      row.claimerTokenId,
+	}
+	if len(row.payload) > 0 {
+		resp.Data = row.payload
+	}
+	return
+}
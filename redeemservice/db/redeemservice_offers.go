@@ -0,0 +1,163 @@
+package db
+
+import (
+	"fmt"
+	"github.com/eluv-io/errors-go"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// offer statuses: an active offer is claimable within its valid window. A paused offer takes no new claims until
+// resumed, and a retired offer never again; tokens that claimed before can still fetch their earlier fulfillment.
+// A disabled offer is rejected altogether.
+const (
+	OfferActive   = "active"
+	OfferPaused   = "paused"
+	OfferRetired  = "retired"
+	OfferDisabled = "disabled"
+)
+
+// reasons of an OfferUnavailableError
+const (
+	ReasonNotRegistered = "not registered"
+	ReasonOtherNetwork  = "registered on another network"
+	ReasonPaused        = "paused"
+	ReasonRetired       = "retired"
+	ReasonDisabled      = "disabled"
+	ReasonNotYetValid   = "not yet valid"
+	ReasonNoLongerValid = "no longer valid"
+)
+
+// Offer is a redeemable offer registered for fulfillment. Redemptions of an offer are only fulfilled while it is
+// registered on the redeeming network, active, and within its valid_from / valid_until window when set.
+type Offer struct {
+	ContractAddress string     `json:"contract_address"`
+	OfferId         string     `json:"offer_id"`
+	Network         string     `json:"network"`
+	Name            string     `json:"name"`
+	ValidFrom       *time.Time `json:"valid_from,omitempty"`
+	ValidUntil      *time.Time `json:"valid_until,omitempty"`
+	Status          string     `json:"status"`
+	Created         time.Time  `json:"created"`
+	Updated         time.Time  `json:"updated"`
+}
+
+// OfferUnavailableError is returned for a redemption of an offer that is not registered, or not claimable now.
+type OfferUnavailableError struct {
+	ContractAddress string `json:"contract_address"`
+	OfferId         string `json:"offer_id"`
+	Reason          string `json:"reason"`
+}
+
+func (e *OfferUnavailableError) Error() string {
+	return fmt.Sprintf("offer %s/%s not available: %s", e.ContractAddress, e.OfferId, e.Reason)
+}
+
+// AllowsEarlierFulfillment tells whether a token that claimed the offer before may still fetch its fulfillment: the
+// offer only stopped taking new claims, or is not registered, as are the offers claimed before registration existed.
+func (e *OfferUnavailableError) AllowsEarlierFulfillment() bool {
+	return e.Reason == ReasonPaused || e.Reason == ReasonRetired || e.Reason == ReasonNoLongerValid ||
+		e.Reason == ReasonNotRegistered
+}
+
+// PutOffer registers `offer`, or updates its registration. The status defaults to that of the registered offer, or to
+// active; a retired offer stays retired.
+func (fp *FulfillmentPersistence) PutOffer(offer Offer) (stored Offer, err error) {
+	offer.ContractAddress = strings.ToLower(offer.ContractAddress)
+
+	var prev Offer
+	if prev, err = fp.GetOffer(offer.ContractAddress, offer.OfferId); err != nil {
+		if !errors.IsKind(errors.K.NotExist, err) {
+			return
+		}
+		prev, err = Offer{Status: OfferActive}, nil
+	}
+	if offer.Status == "" {
+		offer.Status = prev.Status
+	}
+	if err = validateOffer(offer); err != nil {
+		return
+	}
+	if prev.Status == OfferRetired && offer.Status != OfferRetired {
+		err = errors.NoTrace("offer retired", errors.K.Invalid, "offer", offer)
+		return
+	}
+
+	log.Debug("PutOffer", "offer", offer)
+	return fp.store.PutOffer(offer)
+}
+
+// GetOffer returns the registered offer; the error is of kind NotExist if it is not registered.
+func (fp *FulfillmentPersistence) GetOffer(contractAddr, offerId string) (offer Offer, err error) {
+	return fp.store.GetOffer(strings.ToLower(contractAddr), offerId)
+}
+
+// ListOffers lists the registered offers of `contractAddr`, or of all contracts if empty.
+func (fp *FulfillmentPersistence) ListOffers(contractAddr string) (offers []Offer, err error) {
+	return fp.store.ListOffers(strings.ToLower(contractAddr))
+}
+
+// SetOfferStatus changes the status of the registered offer, e.g. to pause, resume or retire it.
+func (fp *FulfillmentPersistence) SetOfferStatus(contractAddr, offerId, status string) (offer Offer, err error) {
+	if offer, err = fp.GetOffer(contractAddr, offerId); err != nil {
+		return
+	}
+	offer.Status = status
+	return fp.PutOffer(offer)
+}
+
+// CheckOffer returns an OfferUnavailableError unless the offer redeemed in `tx` is registered on `network` and
+// claimable at `now`.
+func (fp *FulfillmentPersistence) CheckOffer(network string, tx RedemptionTransaction, now time.Time) (err error) {
+	offerId, _ := tx.OfferAndTokenIds()
+	unavailable := func(reason string) error {
+		return &OfferUnavailableError{ContractAddress: tx.ContractAddress, OfferId: offerId, Reason: reason}
+	}
+
+	var offer Offer
+	if offer, err = fp.GetOffer(tx.ContractAddress, offerId); err != nil {
+		if errors.IsKind(errors.K.NotExist, err) {
+			err = unavailable(ReasonNotRegistered)
+		}
+		return
+	}
+
+	switch {
+	case offer.Network != network:
+		err = unavailable(ReasonOtherNetwork)
+	case offer.Status == OfferPaused:
+		err = unavailable(ReasonPaused)
+	case offer.Status == OfferRetired:
+		err = unavailable(ReasonRetired)
+	case offer.Status != OfferActive:
+		err = unavailable(ReasonDisabled)
+	case offer.ValidFrom != nil && now.Before(*offer.ValidFrom):
+		err = unavailable(ReasonNotYetValid)
+	case offer.ValidUntil != nil && !now.Before(*offer.ValidUntil):
+		err = unavailable(ReasonNoLongerValid)
+	}
+
+	return
+}
+
+func validateOffer(offer Offer) (err error) {
+	e := errors.TemplateNoTrace("invalid offer", errors.K.Invalid, "offer", offer)
+
+	if offer.ContractAddress == "" || offer.Network == "" {
+		return e("reason", "missing contract address or network")
+	}
+	if _, err = strconv.ParseUint(offer.OfferId, 10, 8); err != nil {
+		return e(err, "reason", "offer id must be 0-255")
+	}
+	switch offer.Status {
+	case OfferActive, OfferPaused, OfferRetired, OfferDisabled:
+	default:
+		return e("reason", "unknown status", "status", offer.Status)
+	}
+	if offer.ValidFrom != nil && offer.ValidUntil != nil && !offer.ValidFrom.Before(*offer.ValidUntil) {
+		return e("reason", "valid_from must be before valid_until")
+	}
+
+	return nil
+}
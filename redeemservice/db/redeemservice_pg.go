@@ -0,0 +1,709 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"fulfillmentd/server/db"
+	"github.com/eluv-io/errors-go"
+	"github.com/jackc/pgx"
+	"io/fs"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+//go:embed sql/*.tmpl
+var statementsFS embed.FS
+
+const (
+	maxTxAttempts  = 5
+	txRetryBackoff = 20 * time.Millisecond
+
+	pgSerializationFailure = "40001"
+	pgUniqueViolation      = "23505"
+)
+
+// querier runs statements on either the connection pool or a transaction
+type querier interface {
+	Query(sql string, args ...interface{}) (*pgx.Rows, error)
+	Exec(sql string, arguments ...interface{}) (pgx.CommandTag, error)
+}
+
+// PgStore is the Store on CockroachDB, running the statement templates in sql/.
+type PgStore struct {
+	pool *db.ConnectionManager
+}
+
+func NewPgStore(cm *db.ConnectionManager) *PgStore {
+	log.Info("init PgStore", "cm", cm)
+	return &PgStore{pool: cm}
+}
+
+// SetupFulfillment adds the codes in a single transaction with the lookup and record of the idempotency key, so a load
+// is stored entirely or not at all, and only once per key.
+func (ps *PgStore) SetupFulfillment(setup SetupData) (result SetupResult, err error) {
+	err = ps.runInTx(func(dbTx *pgx.Tx) (err error) {
+		result, err = ps.setupFulfillment(dbTx, setup)
+		return
+	})
+	if setup.IdempotencyKey != "" && isPgError(err, pgUniqueViolation) {
+		// a concurrent load with this key committed first
+		log.Debug("concurrent load", "idempotency_key", setup.IdempotencyKey, "err", err)
+		var found bool
+		result = SetupResult{}
+		if found, err = ps.getLoadRequest(ps.conn(), setup, &result); err == nil && !found {
+			err = errors.NoTrace("concurrent load with the same idempotency key", errors.K.Exist,
+				"idempotency_key", setup.IdempotencyKey)
+		}
+	}
+	return
+}
+
+func (ps *PgStore) setupFulfillment(q querier, setup SetupData) (result SetupResult, err error) {
+	if setup.IdempotencyKey != "" {
+		var found bool
+		if found, err = ps.getLoadRequest(q, setup, &result); err != nil || found {
+			return
+		}
+	}
+
+	var duplicates []string
+	if duplicates, err = ps.importCodes(q, setup.ContractAddress, setup.OfferId, setup.Entries); err != nil {
+		return
+	}
+	result = SetupResult{Loaded: len(setup.Entries) - len(duplicates), Duplicates: duplicates}
+
+	if setup.IdempotencyKey != "" {
+		err = ps.addLoadRequest(q, setup, result)
+	}
+
+	return
+}
+
+// getLoadRequest reads the result of the earlier load with the idempotency key of `setup` into `result`, if any
+func (ps *PgStore) getLoadRequest(q querier, setup SetupData, result *SetupResult) (found bool, err error) {
+	var stmt string
+	if stmt, err = mergeTemplate("sql/get-load-request.tmpl", ps.context()); err != nil {
+		return
+	}
+
+	var rows *pgx.Rows
+	if rows, err = q.Query(stmt, setup.IdempotencyKey); err != nil {
+		return
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		err = rows.Err()
+		return
+	}
+	var requestHash string
+	if err = rows.Scan(&requestHash, result); err != nil {
+		return
+	}
+	if requestHash != setup.requestHash {
+		err = errors.NoTrace("idempotency key reused for another load", errors.K.Exist,
+			"idempotency_key", setup.IdempotencyKey)
+		return
+	}
+	found, result.Replayed = true, true
+
+	return
+}
+
+// addLoadRequest records the result of the load with the idempotency key of `setup`
+func (ps *PgStore) addLoadRequest(q querier, setup SetupData, result SetupResult) (err error) {
+	var stmt string
+	if stmt, err = mergeTemplate("sql/add-load-request.tmpl", ps.context()); err != nil {
+		return
+	}
+
+	var data []byte
+	if data, err = json.Marshal(result); err != nil {
+		return
+	}
+	_, err = q.Exec(stmt, setup.IdempotencyKey, setup.requestHash, string(data))
+
+	return
+}
+
+// ImportCodes inserts the rows in a single transaction, skipping those with a code already in the pool.
+func (ps *PgStore) ImportCodes(contractAddr, offerId string, rows []ImportRow) (duplicates []string, err error) {
+	err = ps.runInTx(func(dbTx *pgx.Tx) (err error) {
+		duplicates, err = ps.importCodes(dbTx, contractAddr, offerId, rows)
+		return
+	})
+	return
+}
+
+// importCodes inserts the rows, in statements of importBatchSize rows to stay within the bind parameters of a
+// statement, and returns the codes of those not inserted, the pool having them already
+func (ps *PgStore) importCodes(q querier, contractAddr, offerId string, rows []ImportRow) (duplicates []string, err error) {
+	duplicates = make([]string, 0)
+	for len(rows) > 0 {
+		n := len(rows)
+		if n > importBatchSize {
+			n = importBatchSize
+		}
+		var dups []string
+		if dups, err = ps.insertCodes(q, contractAddr, offerId, rows[:n]); err != nil {
+			return
+		}
+		duplicates = append(duplicates, dups...)
+		rows = rows[n:]
+	}
+	return
+}
+
+// insertCodes inserts the rows with a single multi-row statement, and returns the codes of those not inserted
+func (ps *PgStore) insertCodes(q querier, contractAddr, offerId string, rows []ImportRow) (duplicates []string, err error) {
+	var values []string
+	args := []interface{}{contractAddr, offerId}
+	for _, row := range rows {
+		n := len(args)
+		values = append(values, fmt.Sprintf("($1, $2, $%d, $%d, $%d, $%d, false)", n+1, n+2, n+3, n+4))
+		args = append(args, row.Url, row.Code, nullJSON(row.Metadata), nullJSON(row.Payload))
+	}
+
+	var stmt string
+	templateArgs := ps.context()
+	templateArgs["values"] = strings.Join(values, ", ")
+	if stmt, err = mergeTemplate("sql/import-codes.tmpl", templateArgs); err != nil {
+		return
+	}
+
+	var res *pgx.Rows
+	if res, err = q.Query(stmt, args...); err != nil {
+		return
+	}
+	defer res.Close()
+
+	inserted := make(map[string]struct{}, len(rows))
+	for res.Next() {
+		var code string
+		if err = res.Scan(&code); err != nil {
+			return
+		}
+		inserted[code] = struct{}{}
+	}
+	if err = res.Err(); err != nil {
+		return
+	}
+	for _, row := range rows {
+		if _, ok := inserted[row.Code]; !ok {
+			duplicates = append(duplicates, row.Code)
+		}
+	}
+
+	return
+}
+
+// ClaimCode runs the check that the token is not yet claimed, the claim and the marking of duplicate url/code rows in a
+// single serializable transaction, so concurrent requests for the same token cannot claim more than one code.
+func (ps *PgStore) ClaimCode(tx RedemptionTransaction) (resp FulfillmentResponse, err error) {
+	offerId, tokenId := tx.OfferAndTokenIds()
+	log.Debug("ClaimCode", "tx", fmt.Sprintf("%+v", tx), "offerId", offerId, "tokenId", tokenId)
+
+	err = ps.runInTx(func(dbTx *pgx.Tx) (err error) {
+		resp, err = ps.claimCode(dbTx, tx, offerId, tokenId)
+		return
+	})
+	if isPgError(err, pgUniqueViolation) {
+		// a concurrent claim for this token committed first
+		log.Debug("concurrent claim", "tx", tx, "err", err)
+		if resp, err = ps.GetRedeemedOffer(tx.ContractAddress, offerId, tokenId); err == nil {
+			err = errors.NoTrace("token already claimed", errors.K.Invalid, "tx", tx)
+		}
+	}
+
+	return
+}
+
+func (ps *PgStore) claimCode(q querier, tx RedemptionTransaction, offerId, tokenId string) (resp FulfillmentResponse, err error) {
+	resp, err = ps.getRedeemedOffer(q, tx.ContractAddress, offerId, tokenId)
+	if err != nil {
+		return
+	}
+	if resp.Claimed {
+		err = errors.NoTrace("token already claimed", errors.K.Invalid, "tx", tx)
+		return
+	}
+
+	var stmt string
+	templateArgs := ps.context()
+	if stmt, err = mergeTemplate("sql/update-mapping.tmpl", templateArgs); err != nil {
+		return
+	}
+
+	var args []interface{}
+	args = append(args, tokenId)
+	args = append(args, tx.RedeemerAddress)
+	args = append(args, tx.ContractAddress)
+	args = append(args, offerId)
+	//log.Trace("claimCode", "stmt", stmt, "args", args)
+
+	var rows *pgx.Rows
+	if rows, err = q.Query(stmt, args...); err != nil {
+		return
+	}
+
+	var found bool
+	if found = rows.Next(); found {
+		resp, err = scanFulfillmentData(rows, tx.ContractAddress, offerId, tokenId)
+	}
+	rows.Close()
+	if err == nil {
+		err = rows.Err()
+	}
+	if err != nil {
+		return
+	}
+
+	if found {
+		// fulfillment successful
+		if resp.Claimed {
+			resp.UserAddr = tx.RedeemerAddress
+
+			// a code with a payload and no url is not shared with other contracts
+			if resp.Url != "" {
+				err = ps.markUrlAndCodeClaimed(q, resp.Url, resp.Code)
+				if err != nil {
+					return
+				}
+			}
+		}
+	} else {
+		// fulfillment failed; see why
+		var stats []OfferStats
+		stats, err = ps.getStats(q, tx.ContractAddress, offerId, nil)
+		if err != nil {
+			return
+		}
+
+		if len(stats) == 0 || stats[0].Remaining == 0 {
+			err = errors.NoTrace("no more redemption codes available", errors.K.NotFound, "tx", tx)
+		} else {
+			err = errors.NoTrace("unable to redeem", errors.K.Invalid, "tx", tx)
+		}
+	}
+
+	return
+}
+
+func (ps *PgStore) markUrlAndCodeClaimed(q querier, url, code string) (err error) {
+	var stmt string
+	templateArgs := ps.context()
+	if stmt, err = mergeTemplate("sql/mark-url-and-code-claimed.tmpl", templateArgs); err != nil {
+		return
+	}
+
+	var args []interface{}
+	args = append(args, url)
+	args = append(args, code)
+
+	var rows *pgx.Rows
+	if rows, err = q.Query(stmt, args...); err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var otherContracts []string
+	otherContracts, err = scanDups(rows)
+	if err != nil {
+		return
+	}
+	if len(otherContracts) > 0 {
+		log.Debug("marked this Url and Code claimed", "otherContracts", otherContracts)
+	}
+
+	return
+}
+
+func (ps *PgStore) GetRedeemedOffer(contractAddr, redeemableId, tokenId string) (resp FulfillmentResponse, err error) {
+	return ps.getRedeemedOffer(ps.conn(), contractAddr, redeemableId, tokenId)
+}
+
+func (ps *PgStore) getRedeemedOffer(q querier, contractAddr, redeemableId, tokenId string) (resp FulfillmentResponse, err error) {
+	var stmt string
+	templateArgs := ps.context()
+	if stmt, err = mergeTemplate("sql/get-mapping.tmpl", templateArgs); err != nil {
+		return
+	}
+
+	var args []interface{}
+	args = append(args, contractAddr)
+	args = append(args, redeemableId)
+	args = append(args, tokenId)
+	//log.Trace("GetRedeemedOffer", "stmt", stmt, "args", args)
+
+	var rows *pgx.Rows
+	if rows, err = q.Query(stmt, args...); err != nil {
+		return
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		resp, err = scanFulfillmentData(rows, contractAddr, redeemableId, tokenId)
+	}
+
+	return
+}
+
+func (ps *PgStore) GetUnclaimed(contractAddr, redeemableId string) (unclaimed []string, err error) {
+	return ps.getUnclaimed(ps.conn(), contractAddr, redeemableId)
+}
+
+func (ps *PgStore) getUnclaimed(q querier, contractAddr, redeemableId string) (unclaimed []string, err error) {
+	log.Debug("GetUnclaimed", "contractAddr", contractAddr, "redeemableId", redeemableId)
+	var stmt string
+	templateArgs := ps.context()
+	if stmt, err = mergeTemplate("sql/get-unclaimed.tmpl", templateArgs); err != nil {
+		return
+	}
+
+	var args []interface{}
+	args = append(args, contractAddr)
+	args = append(args, redeemableId)
+
+	var rows *pgx.Rows
+	if rows, err = q.Query(stmt, args...); err != nil {
+		return
+	}
+	defer rows.Close()
+
+	unclaimed = make([]string, 0)
+	for rows.Next() {
+		var url, code sql.NullString
+		if err = rows.Scan(&url, &code); err != nil {
+			return
+		}
+		if code.Valid {
+			unclaimed = append(unclaimed, code.String)
+		}
+	}
+
+	return
+}
+
+// GetStats counts the codes of each offer in a single aggregate statement, with a claim count column per `since`.
+func (ps *PgStore) GetStats(contractAddr, offerId string, since []time.Time) (stats []OfferStats, err error) {
+	return ps.getStats(ps.conn(), contractAddr, offerId, since)
+}
+
+func (ps *PgStore) getStats(q querier, contractAddr, offerId string, since []time.Time) (stats []OfferStats, err error) {
+	var windows strings.Builder
+	args := []interface{}{contractAddr, offerId}
+	for _, t := range since {
+		args = append(args, t)
+		_, _ = fmt.Fprintf(&windows, ", count(*) FILTER (WHERE claimer_token_id IS NOT NULL AND updated > $%d)", len(args))
+	}
+
+	var stmt string
+	templateArgs := ps.context()
+	templateArgs["windows"] = windows.String()
+	if stmt, err = mergeTemplate("sql/get-stats.tmpl", templateArgs); err != nil {
+		return
+	}
+
+	var rows *pgx.Rows
+	if rows, err = q.Query(stmt, args...); err != nil {
+		return
+	}
+	defer rows.Close()
+
+	stats = make([]OfferStats, 0)
+	for rows.Next() {
+		st := OfferStats{ContractAddress: contractAddr, ClaimRates: make([]ClaimRate, len(since))}
+		var first, last sql.NullTime
+		dest := []interface{}{&st.OfferId, &st.Total, &st.Claimed}
+		for i := range st.ClaimRates {
+			dest = append(dest, &st.ClaimRates[i].Claimed)
+		}
+		dest = append(dest, &first, &last)
+		if err = rows.Scan(dest...); err != nil {
+			return
+		}
+		st.Remaining = st.Total - st.Claimed
+		if first.Valid {
+			st.FirstClaim = &first.Time
+		}
+		if last.Valid {
+			st.LastClaim = &last.Time
+		}
+		stats = append(stats, st)
+	}
+	err = rows.Err()
+
+	return
+}
+
+func (ps *PgStore) AddAlert(contractAddr, offerId, threshold string) (added bool, err error) {
+	var stmt string
+	if stmt, err = mergeTemplate("sql/add-alert.tmpl", ps.context()); err != nil {
+		return
+	}
+
+	var rows *pgx.Rows
+	if rows, err = ps.conn().Query(stmt, contractAddr, offerId, threshold); err != nil {
+		return
+	}
+	defer rows.Close()
+
+	added = rows.Next()
+	err = rows.Err()
+
+	return
+}
+
+func (ps *PgStore) DeleteAlert(contractAddr, offerId, threshold string) (err error) {
+	var stmt string
+	if stmt, err = mergeTemplate("sql/delete-alert.tmpl", ps.context()); err != nil {
+		return
+	}
+	_, err = ps.conn().Exec(stmt, contractAddr, offerId, threshold)
+
+	return
+}
+
+func (ps *PgStore) PutOffer(offer Offer) (stored Offer, err error) {
+	var stmt string
+	if stmt, err = mergeTemplate("sql/put-offer.tmpl", ps.context()); err != nil {
+		return
+	}
+
+	var args []interface{}
+	args = append(args, offer.ContractAddress)
+	args = append(args, offer.OfferId)
+	args = append(args, offer.Network)
+	args = append(args, offer.Name)
+	args = append(args, nullTime(offer.ValidFrom))
+	args = append(args, nullTime(offer.ValidUntil))
+	args = append(args, offer.Status)
+
+	var rows *pgx.Rows
+	if rows, err = ps.conn().Query(stmt, args...); err != nil {
+		return
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err == nil {
+			err = errors.NoTrace("offer not stored", errors.K.Invalid, "offer", offer)
+		}
+		return
+	}
+	stored, err = scanOffer(rows)
+	return
+}
+
+func (ps *PgStore) GetOffer(contractAddr, offerId string) (offer Offer, err error) {
+	var stmt string
+	if stmt, err = mergeTemplate("sql/get-offer.tmpl", ps.context()); err != nil {
+		return
+	}
+
+	var rows *pgx.Rows
+	if rows, err = ps.conn().Query(stmt, contractAddr, offerId); err != nil {
+		return
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err == nil {
+			err = errors.NoTrace("offer not registered", errors.K.NotExist, "contract_addr", contractAddr,
+				"offer_id", offerId)
+		}
+		return
+	}
+	offer, err = scanOffer(rows)
+	return
+}
+
+func (ps *PgStore) ListOffers(contractAddr string) (offers []Offer, err error) {
+	var stmt string
+	if stmt, err = mergeTemplate("sql/list-offers.tmpl", ps.context()); err != nil {
+		return
+	}
+
+	var rows *pgx.Rows
+	if rows, err = ps.conn().Query(stmt, contractAddr); err != nil {
+		return
+	}
+	defer rows.Close()
+
+	offers = make([]Offer, 0)
+	for rows.Next() {
+		var offer Offer
+		if offer, err = scanOffer(rows); err != nil {
+			return
+		}
+		offers = append(offers, offer)
+	}
+	err = rows.Err()
+
+	return
+}
+
+func scanOffer(rows *pgx.Rows) (offer Offer, err error) {
+	var validFrom, validUntil sql.NullTime
+	if err = rows.Scan(&offer.ContractAddress, &offer.OfferId, &offer.Network, &offer.Name, &validFrom, &validUntil,
+		&offer.Status, &offer.Created, &offer.Updated); err != nil {
+		return
+	}
+	if validFrom.Valid {
+		offer.ValidFrom = &validFrom.Time
+	}
+	if validUntil.Valid {
+		offer.ValidUntil = &validUntil.Time
+	}
+	return
+}
+
+// nullJSON returns `data` as a nullable json argument
+func nullJSON(data json.RawMessage) interface{} {
+	if len(data) == 0 {
+		return nil
+	}
+	return string(data)
+}
+
+// nullTime returns `t` as a nullable timestamp argument
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *t, Valid: true}
+}
+
+func scanFulfillmentData(rows *pgx.Rows, contractAddr, redeemableId, tokenId string) (row FulfillmentResponse, err error) {
+	var claimed sql.NullBool
+	var addr, url, code sql.NullString
+	var payload []byte
+	var created, updated sql.NullTime
+	if err = rows.Scan(&claimed, &addr, &url, &code, &payload, &created, &updated); err != nil {
+		return
+	}
+	if claimed.Valid {
+		row = FulfillmentResponse{
+			Claimed:  claimed.Bool,
+			UserAddr: addr.String,
+			Created:  created.Time,
+			Updated:  updated.Time,
+			Url:      url.String,
+			Code:     code.String,
+
+			ContractAddr: contractAddr,
+			OfferId:      redeemableId,
+			TokenId:      tokenId,
+		}
+		if len(payload) > 0 {
+			row.Data = json.RawMessage(payload)
+		}
+	}
+
+	return
+}
+
+func scanDups(rows *pgx.Rows) (otherContracts []string, err error) {
+	otherContracts = make([]string, 0)
+
+	for rows.Next() {
+		var addr sql.NullString
+		if err = rows.Scan(&addr); err != nil {
+			return
+		}
+		if addr.Valid {
+			otherContracts = append(otherContracts, addr.String)
+		}
+	}
+
+	return
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+func mergeTemplate(path string, ctx map[string]interface{}) (stmt string, err error) {
+	if stmt, err = mergeTemplateFS(statementsFS, path, ctx); err != nil {
+		return
+	}
+	stmt = whitespace.ReplaceAllString(stmt, " ")
+	return
+}
+
+// mergeTemplateFS merges the template at `path` in `fsys`, keeping its line breaks so that `--` comments end
+func mergeTemplateFS(fsys fs.FS, path string, ctx map[string]interface{}) (stmt string, err error) {
+	var b []byte
+	if b, err = fs.ReadFile(fsys, path); err != nil {
+		return
+	}
+
+	var t *template.Template
+	if t, err = template.New(path).Parse(string(b)); err != nil {
+		return
+	}
+	buf := new(bytes.Buffer)
+	if err = t.Execute(buf, ctx); err != nil {
+		return
+	}
+
+	stmt = buf.String()
+	return
+}
+
+// runInTx runs `fn` in a serializable transaction, retrying the whole transaction when it fails to serialize with a
+// concurrent one.
+func (ps *PgStore) runInTx(fn func(dbTx *pgx.Tx) error) (err error) {
+	for attempt := 1; ; attempt++ {
+		err = ps.tryTx(fn)
+		if !isPgError(err, pgSerializationFailure) || attempt >= maxTxAttempts {
+			return
+		}
+		log.Debug("retrying transaction", "attempt", attempt, "err", err)
+		time.Sleep(time.Duration(attempt) * txRetryBackoff)
+	}
+}
+
+func (ps *PgStore) tryTx(fn func(dbTx *pgx.Tx) error) (err error) {
+	var dbTx *pgx.Tx
+	if dbTx, err = ps.conn().BeginEx(context.Background(), &pgx.TxOptions{IsoLevel: pgx.Serializable}); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = dbTx.Rollback()
+		}
+	}()
+
+	if err = fn(dbTx); err != nil {
+		return
+	}
+	err = dbTx.Commit()
+	return
+}
+
+func isPgError(err error, code string) bool {
+	var pgErr pgx.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == code
+	}
+	return false
+}
+
+func (ps *PgStore) conn() *pgx.ConnPool {
+	return ps.pool.GetConn()
+}
+
+func (ps *PgStore) context() map[string]interface{} {
+	return dbContext()
+}
+
+func dbContext() map[string]interface{} {
+	return map[string]interface{}{
+		"database": "fulfillmentservice",
+	}
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"encoding/json"
+	"github.com/eluv-io/errors-go"
+	"io/ioutil"
+	"strings"
+)
+
+// Simulation resolves transactions from a fixture file of fake receipts rather than the chain, for sandbox
+// deployments and trying out the API. It is only used when enabled by the simulation config.
+type Simulation struct {
+	receipts map[string]SimulatedReceipt
+}
+
+// SimulationFixtures is the content of a simulation fixture file.
+type SimulationFixtures struct {
+	Receipts []SimulatedReceipt `json:"receipts"`
+}
+
+// SimulatedReceipt is a fake receipt of a transaction redeeming one or more offers. A redemption without
+// user_address is redeemed by whichever user requests the fulfillment.
+type SimulatedReceipt struct {
+	Transaction string                  `json:"transaction"`
+	Redemptions []RedemptionTransaction `json:"redemptions"`
+}
+
+// LoadSimulation reads the simulation fixture file at `path`.
+func LoadSimulation(path string) (sim *Simulation, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		err = errors.E("cannot read simulation fixtures", errors.K.Invalid, err, "path", path)
+		return
+	}
+
+	var fixtures SimulationFixtures
+	if err = json.Unmarshal(data, &fixtures); err != nil {
+		err = errors.E("cannot parse simulation fixtures", errors.K.Invalid, err, "path", path)
+		return
+	}
+
+	sim = &Simulation{receipts: make(map[string]SimulatedReceipt, len(fixtures.Receipts))}
+	for _, r := range fixtures.Receipts {
+		if r.Transaction == "" || len(r.Redemptions) == 0 {
+			err = errors.E("invalid simulated receipt", errors.K.Invalid, "path", path, "receipt", r)
+			return
+		}
+		for i := range r.Redemptions {
+			r.Redemptions[i].ContractAddress = strings.ToLower(r.Redemptions[i].ContractAddress)
+			r.Redemptions[i].RedeemerAddress = strings.ToLower(r.Redemptions[i].RedeemerAddress)
+		}
+		sim.receipts[strings.ToLower(r.Transaction)] = r
+	}
+	log.Warn("simulation mode: transactions are resolved from fixtures, not the chain", "path", path,
+		"receipts", len(sim.receipts))
+
+	return
+}
+
+// ResolveTransaction returns the redemptions of the simulated receipt of the request transaction.
+func (sim *Simulation) ResolveTransaction(request FulfillmentRequest) (rts []RedemptionTransaction, err error) {
+	r, ok := sim.receipts[strings.ToLower(request.Transaction)]
+	if !ok {
+		err = errors.NoTrace("no simulated receipt for tx", errors.K.NotFound, "tx", request.Transaction)
+		return
+	}
+
+	rts = make([]RedemptionTransaction, 0, len(r.Redemptions))
+	for _, rt := range r.Redemptions {
+		if rt.RedeemerAddress == "" {
+			rt.RedeemerAddress = request.UserAddress
+		}
+		rts = append(rts, rt)
+	}
+	log.Debug("simulated redemptions", "tx", request.Transaction, "redemptions", rts)
+
+	return
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"strings"
+	"time"
+)
+
+// ClaimWindow is a period before now over which the claim rate of an offer is reported.
+type ClaimWindow struct {
+	Name     string
+	Duration time.Duration
+}
+
+// ClaimWindows are the windows of OfferStats.ClaimRates.
+var ClaimWindows = []ClaimWindow{
+	{Name: "1h", Duration: time.Hour},
+	{Name: "24h", Duration: 24 * time.Hour},
+	{Name: "7d", Duration: 7 * 24 * time.Hour},
+}
+
+// OfferStats is the inventory of the code pool of an offer. Claimed counts the codes claimed by a token, and those
+// marked claimed as duplicates of a url and code claimed for another contract; the claim rates and times only count
+// claims by a token.
+type OfferStats struct {
+	ContractAddress string      `json:"contract_address"`
+	OfferId         string      `json:"offer_id"`
+	Total           int         `json:"total"`
+	Claimed         int         `json:"claimed"`
+	Remaining       int         `json:"remaining"`
+	ClaimRates      []ClaimRate `json:"claim_rates"`
+	FirstClaim      *time.Time  `json:"first_claim,omitempty"`
+	LastClaim       *time.Time  `json:"last_claim,omitempty"`
+}
+
+// ClaimRate is the number of claims over a ClaimWindow, and the hourly rate.
+type ClaimRate struct {
+	Window  string  `json:"window"`
+	Claimed int     `json:"claimed"`
+	PerHour float64 `json:"per_hour"`
+}
+
+// GetStats returns the inventory of the offer of the contract, or of each of its offers with codes if `offerId` is
+// empty, with the claim rates over the ClaimWindows before `now`. An offer without codes has an all zero inventory.
+func (fp *FulfillmentPersistence) GetStats(contractAddr, offerId string, now time.Time) (stats []OfferStats, err error) {
+	contractAddr = strings.ToLower(contractAddr)
+	since := make([]time.Time, 0, len(ClaimWindows))
+	for _, w := range ClaimWindows {
+		since = append(since, now.Add(-w.Duration))
+	}
+
+	if stats, err = fp.store.GetStats(contractAddr, offerId, since); err != nil {
+		return
+	}
+	if len(stats) == 0 && offerId != "" {
+		stats = append(stats, OfferStats{
+			ContractAddress: contractAddr,
+			OfferId:         offerId,
+			ClaimRates:      make([]ClaimRate, len(ClaimWindows)),
+		})
+	}
+
+	for i := range stats {
+		for j, w := range ClaimWindows {
+			rate := &stats[i].ClaimRates[j]
+			rate.Window = w.Name
+			rate.PerHour = float64(rate.Claimed) / w.Duration.Hours()
+		}
+	}
+
+	return
+}
+
+// AddAlert records the low-inventory alert of the threshold as fired for the offer; added is false if it already was.
+func (fp *FulfillmentPersistence) AddAlert(contractAddr, offerId, threshold string) (added bool, err error) {
+	return fp.store.AddAlert(contractAddr, offerId, threshold)
+}
+
+// DeleteAlert re-arms the low-inventory alert of the threshold for the offer.
+func (fp *FulfillmentPersistence) DeleteAlert(contractAddr, offerId, threshold string) (err error) {
+	return fp.store.DeleteAlert(contractAddr, offerId, threshold)
+}
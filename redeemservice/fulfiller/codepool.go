@@ -0,0 +1,23 @@
+package fulfiller
+
+import (
+	"fulfillmentd/redeemservice/db"
+)
+
+// CodePool is the built-in sample fulfillment: each redeemed token claims one unclaimed URL + code that was loaded
+// for its contract and offer, mirroring a coupon (the code) for a website purchase (the URL).
+type CodePool struct {
+	db *db.FulfillmentPersistence
+}
+
+func NewCodePool(fp *db.FulfillmentPersistence) *CodePool {
+	return &CodePool{db: fp}
+}
+
+func (cp *CodePool) FulfillRedeemableOffer(tx db.RedemptionTransaction) (db.FulfillmentResponse, error) {
+	return cp.db.ClaimCode(tx)
+}
+
+func (cp *CodePool) GetRedeemedOffer(contractAddr, offerId, tokenId string) (db.FulfillmentResponse, error) {
+	return cp.db.GetRedeemedOffer(contractAddr, offerId, tokenId)
+}
@@ -0,0 +1,83 @@
+// Package fulfiller separates the fulfillment daemon from the customer "fulfillment custom function".
+//
+// The daemon verifies the redemption transaction and the redeeming user, then calls the Fulfiller registered for the
+// redeemed contract and offer. Offers with no registered Fulfiller use the built-in CodePool sample.
+//
+// A custom fulfiller is registered without forking the daemon, typically from an init function:
+//
+//	func init() {
+//		fulfiller.Register("0xb914ad493a0a4fe5a899dc21b66a509bcf8f1ed9", fulfiller.AnyOffer, &MyFulfiller{})
+//	}
+package fulfiller
+
+import (
+	"fulfillmentd/redeemservice/db"
+	elog "github.com/eluv-io/log-go"
+	"strings"
+	"sync"
+)
+
+var log = elog.Get("/fs/fulfiller")
+
+// AnyOffer registers a Fulfiller for all offers of a contract.
+const AnyOffer = "*"
+
+// Fulfiller is the customer "fulfillment custom function" interface.
+type Fulfiller interface {
+	// FulfillRedeemableOffer delivers the offer redeemed in the verified transaction `tx`. The returned Data (or
+	// Url + Code) is delivered to the user as json. It returns an error if the token was already fulfilled, or if
+	// nothing is left to deliver.
+	FulfillRedeemableOffer(tx db.RedemptionTransaction) (db.FulfillmentResponse, error)
+
+	// GetRedeemedOffer returns an earlier fulfillment of the contract, offer and token; Claimed is false if none.
+	GetRedeemedOffer(contractAddr, offerId, tokenId string) (db.FulfillmentResponse, error)
+}
+
+// Registry maps a contract and offer to the Fulfiller for it.
+type Registry struct {
+	mu         sync.RWMutex
+	fulfillers map[string]Fulfiller
+}
+
+var defaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{fulfillers: make(map[string]Fulfiller)}
+}
+
+// Default returns the registry used by the fulfillment service.
+func Default() *Registry {
+	return defaultRegistry
+}
+
+// Register adds `f` to the default registry for `contractAddr` and `offerId`, or for all its offers with AnyOffer.
+func Register(contractAddr, offerId string, f Fulfiller) {
+	defaultRegistry.Register(contractAddr, offerId, f)
+}
+
+// Register adds `f` for `contractAddr` and `offerId`, or for all its offers with AnyOffer. A later registration for
+// the same contract and offer replaces the earlier one.
+func (r *Registry) Register(contractAddr, offerId string, f Fulfiller) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	log.Info("registering fulfiller", "contract_addr", contractAddr, "offer_id", offerId)
+	r.fulfillers[key(contractAddr, offerId)] = f
+}
+
+// Lookup returns the Fulfiller for `contractAddr` and `offerId`, preferring one registered for that exact offer over
+// one registered for AnyOffer.
+func (r *Registry) Lookup(contractAddr, offerId string) (f Fulfiller, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if f, ok = r.fulfillers[key(contractAddr, offerId)]; ok {
+		return
+	}
+	f, ok = r.fulfillers[key(contractAddr, AnyOffer)]
+	return
+}
+
+func key(contractAddr, offerId string) string {
+	return strings.ToLower(contractAddr) + "/" + offerId
+}
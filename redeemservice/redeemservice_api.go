@@ -3,20 +3,26 @@
 //
 // $ curl -s http://localhost:2023/fulfill/:tx
 // {
-//  "message": "fulfilled redeemable offer",
-//  "fulfillment_data": {
-//    "url": "https://eluv.io/",
-//    "code": "XYZ789"
-//  },
-//  "transaction": {
-//    "contract_address": "0xb914ad493a0a4fe5a899dc21b66a509bcf8f1ed9",
-//    "user_address": "0xb516b92fe8f422555f0d04ef139c6a68fe57af08",
-//    "token_id": 34,
-//    "offer_id": 0
-//  }
+//  "message": "fulfilled redeemable offers",
+//  "fulfillments": [
+//    {
+//      "status": "fulfilled",
+//      "message": "fulfilled redeemable offer",
+//      "fulfillment_data": {
+//        "url": "https://eluv.io/",
+//        "code": "XYZ789"
+//      },
+//      "transaction": {
+//        "contract_address": "0xb914ad493a0a4fe5a899dc21b66a509bcf8f1ed9",
+//        "user_address": "0xb516b92fe8f422555f0d04ef139c6a68fe57af08",
+//        "token_id": 34,
+//        "offer_id": 0
+//      }
+//    }
+//  ]
 //}
 //
-// $ curl -s http://localhost:2023/load/:token_addr/:redeemable_id --data '{ "url": "https://eluv.io/", "codes": [ "ABC123", "XYZ789" ] }'
+// $ curl -s http://localhost:2024/load/:token_addr/:redeemable_id --data '{ "url": "https://eluv.io/", "codes": [ "ABC123", "XYZ789" ] }'
 // {
 //  "message": "loaded fulfillment data for a redeemable offer",
 //  "contract_addr": "0xb914ad493a0a4fe5a899dc21b66a509bcf8f1ed9",
@@ -24,6 +30,31 @@
 //  "url": "https://eluv.io/",
 //  "codes": [ "ABC123", "XYZ789" ]
 //}
+//
+// $ curl -s http://localhost:2024/:network/import/:token_addr/:redeemable_id?url=https://eluv.io/ -H 'Content-Type: text/csv' --data-binary @codes.csv
+// {
+//  "message": "imported fulfillment data for a redeemable offer",
+//  "contract_addr": "0xb914ad493a0a4fe5a899dc21b66a509bcf8f1ed9",
+//  "offer_id": "0",
+//  "rows": 3,
+//  "inserted": 1,
+//  "duplicates": 1,
+//  "rejected": 1,
+//  "duplicate_codes": [ "ABC123" ],
+//  "rejected_rows": [ { "line": 4, "reason": "missing code" } ]
+//}
+//
+// $ curl -s -X PUT http://localhost:2024/:network/offers/:token_addr/:redeemable_id --data '{ "name": "Goat One VIP", "valid_until": "2024-01-01T00:00:00Z" }'
+// {
+//  "contract_address": "0xb914ad493a0a4fe5a899dc21b66a509bcf8f1ed9",
+//  "offer_id": "0",
+//  "network": "demov3",
+//  "name": "Goat One VIP",
+//  "valid_until": "2024-01-01T00:00:00Z",
+//  "status": "active",
+//  "created": "2023-06-01T12:00:00Z",
+//  "updated": "2023-06-01T12:00:00Z"
+//}
 
 package api
 
@@ -31,60 +62,130 @@ import (
 	"fulfillmentd/redeemservice/db"
 	"fulfillmentd/server"
 	"fulfillmentd/utils"
+	"github.com/eluv-io/errors-go"
 	elog "github.com/eluv-io/log-go"
 	"github.com/gin-gonic/gin"
+	"io"
+	"math"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 var log = elog.Get("/fs/api")
 
+// fulfillment item statuses
+const (
+	StatusFulfilled        = "fulfilled"
+	StatusAlreadyFulfilled = "already_fulfilled"
+	StatusOfferUnavailable = "offer_unavailable"
+	StatusFailed           = "failed"
+)
+
 type FulfillmentResponse struct {
+	Message      string            `json:"message"`
+	Fulfillments []FulfillmentItem `json:"fulfillments"`
+}
+
+// FulfillmentItem is the result of fulfilling one redemption in the transaction
+type FulfillmentItem struct {
+	Status          string                   `json:"status"`
 	Message         string                   `json:"message"`
-	FulfillmentData interface{}              `json:"fulfillment_data"`
+	FulfillmentData interface{}              `json:"fulfillment_data,omitempty"`
 	Transaction     db.RedemptionTransaction `json:"transaction"`
+	Err             error                    `json:"err,omitempty"`
 }
 
+// LoadRequest is a url and codes to load, and entries each with a code and its own url, or a payload delivered
+// verbatim as the fulfillment data of the code.
 type LoadRequest struct {
-	Url   string   `json:"url"`
-	Codes []string `json:"codes"`
+	Url     string         `json:"url"`
+	Codes   []string       `json:"codes"`
+	Entries []db.ImportRow `json:"entries"`
 }
 
+// LoadResponse reports the codes of a load: `loaded` were added to the pool, and `duplicates` were skipped, being in
+// the pool already or repeated in the request.
 type LoadResponse struct {
 	Message      string   `json:"message"`
 	ContractAddr string   `json:"contract_addr"`
 	OfferId      string   `json:"offer_id"`
 	Url          string   `json:"url"`
 	Codes        []string `json:"codes"`
+	Loaded       int      `json:"loaded"`
+	Duplicates   []string `json:"duplicates"`
+}
+
+// OfferRequest registers an offer; times are RFC 3339, and the status is one of "active", "paused", "retired" or
+// "disabled", by default that of the registered offer or "active".
+type OfferRequest struct {
+	Name       string     `json:"name"`
+	ValidFrom  *time.Time `json:"valid_from"`
+	ValidUntil *time.Time `json:"valid_until"`
+	Status     string     `json:"status"`
+}
+
+type ImportResponse struct {
+	Message      string `json:"message"`
+	ContractAddr string `json:"contract_addr"`
+	OfferId      string `json:"offer_id"`
+	db.ImportSummary
+	Err error `json:"err,omitempty"`
+}
+
+type ExportResponse struct {
+	ContractAddr string   `json:"contract_addr"`
+	OfferId      string   `json:"offer_id"`
+	Unclaimed    []string `json:"unclaimed"`
 }
 
 func AddRoutes(s *server.Server) {
 	log.Info("Adding FS routes")
 	public := s.Router.Group("/")
-	public.POST(":network/load/:contract_addr/:redeemable_id", LoadFulfillmentData(s.FulfillmentService))
 	public.GET(":network/fulfill/:transaction_id", FulfillRedeemableOffer(s.FulfillmentService))
 }
 
+// AddAdminRoutes registers the admin APIs on the admin listener; each requires an admin bearer token.
+func AddAdminRoutes(s *server.Server) {
+	log.Info("Adding FS admin routes")
+	admin := s.AdminRouter.Group("/", AdminAuth(s.FulfillmentService))
+	admin.POST(":network/load/:contract_addr/:redeemable_id", LoadFulfillmentData(s.FulfillmentService))
+	admin.POST(":network/import/:contract_addr/:redeemable_id", ImportFulfillmentData(s.FulfillmentService))
+	admin.GET(":network/export/:contract_addr/:redeemable_id", ExportFulfillmentData(s.FulfillmentService))
+	admin.GET(":network/stats/:contract_addr/:redeemable_id", GetStats(s.FulfillmentService))
+	admin.GET(":network/stats/:contract_addr", GetStats(s.FulfillmentService))
+	admin.PUT(":network/offers/:contract_addr/:redeemable_id", PutOffer(s.FulfillmentService))
+	admin.GET(":network/offers/:contract_addr/:redeemable_id", GetOffer(s.FulfillmentService))
+	admin.GET(":network/offers/:contract_addr", ListOffers(s.FulfillmentService))
+	admin.POST(":network/offers/:contract_addr/:redeemable_id/pause", SetOfferStatus(s.FulfillmentService, db.OfferPaused))
+	admin.POST(":network/offers/:contract_addr/:redeemable_id/resume", SetOfferStatus(s.FulfillmentService, db.OfferActive))
+	admin.POST(":network/offers/:contract_addr/:redeemable_id/retire", SetOfferStatus(s.FulfillmentService, db.OfferRetired))
+	admin.GET("status", Status(s))
+}
+
 // LoadFulfillmentData godoc
 // @ID offer-redemption-load
 // @Summary Load fulfillment data for a redeemable offer
 // @Description Load fulfillment data for a redeemable offer
-// @Param network path string true "which ELV network the contract is on: 'main' or 'demov3'.  This is ignored for now."
+// @Security BearerAuth: signed by an admin of the contract, or by its owner with admin.allow_contract_owner
+// @Param network path string true "which ELV network the contract is on: 'main' or 'demov3'.  Only used to look up the contract owner."
 // @Param contract_addr path string true "the contract address of the redeemable offer"
 // @Param redeemable_id path string true "the redeemable offer id"
-// @Param load_request body LoadRequest true "the fulfillment data url and codes to load"
+// @Param load_request body LoadRequest true "the fulfillment data url and codes, or entries with a payload, to load"
+// @Param Idempotency-Key header string false "a unique key of the load: a retry with the same key and body returns the first response, with the Idempotent-Replayed header, and a different body is rejected with 422"
 // @Produce  json
 // @Router /:network/load/:contact_addr/:redeemable_id [POST]
 func LoadFulfillmentData(fs *server.FulfillmentService) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		var err error
 
-		network := ctx.Param("network")
-		log.Info("LoadFulfillmentData ignores network for now", "network", network)
-
 		var loadRequest LoadRequest
 		if err = ctx.ShouldBind(&loadRequest); err != nil {
 			log.Warn("error binding request body", "err", err)
-			ctx.JSON(http.StatusBadRequest, gin.H{"message": "error binding request body"})
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "error binding request body", "err": err})
+			return
 		}
 
 		contractAddr := ctx.Param("contract_addr")
@@ -95,10 +196,13 @@ func LoadFulfillmentData(fs *server.FulfillmentService) gin.HandlerFunc {
 			OfferId:         redeemableId,
 			Url:             loadRequest.Url,
 			Codes:           loadRequest.Codes,
+			Entries:         loadRequest.Entries,
+			IdempotencyKey:  ctx.GetHeader("Idempotency-Key"),
 		}
-		if err = fs.SetupFulfillment(setupData); err != nil {
+		var result db.SetupResult
+		if result, err = fs.SetupFulfillment(setupData); err != nil {
 			log.Debug("error with loadRequest setup", "err", err)
-			ctx.JSON(http.StatusBadRequest, gin.H{
+			ctx.JSON(statusOf(err), gin.H{
 				"message": "error loading fulfillment loadRequest",
 				"err":     err,
 			})
@@ -111,15 +215,318 @@ func LoadFulfillmentData(fs *server.FulfillmentService) gin.HandlerFunc {
 			OfferId:      redeemableId,
 			Url:          loadRequest.Url,
 			Codes:        loadRequest.Codes,
+			Loaded:       result.Loaded,
+			Duplicates:   result.Duplicates,
+		}
+		if result.Replayed {
+			ctx.Header("Idempotent-Replayed", "true")
 		}
 		ctx.JSON(http.StatusOK, ret)
 	}
 }
 
+// ImportFulfillmentData godoc
+// @ID offer-redemption-import
+// @Summary Import fulfillment data for a redeemable offer from a CSV or JSONL file
+// @Description Import the rows of a CSV or JSONL file, streamed as the request body or as the `file` part of a
+// @Description multipart form, into the code pool of a redeemable offer. Responds with the number of inserted,
+// @Description duplicate and rejected rows.
+// @Security BearerAuth: signed by an admin of the contract, or by its owner with admin.allow_contract_owner
+// @Param network path string true "which ELV network the contract is on: 'main' or 'demov3'.  Only used to look up the contract owner."
+// @Param contract_addr path string true "the contract address of the redeemable offer"
+// @Param redeemable_id path string true "the redeemable offer id"
+// @Param url query string false "the url of rows without one"
+// @Param format query string false "'csv' or 'jsonl'; by default from the content type, or the file name of a multipart file"
+// @Accept text/csv,application/x-ndjson,multipart/form-data
+// @Produce  json
+// @Router /:network/import/:contact_addr/:redeemable_id [POST]
+func ImportFulfillmentData(fs *server.FulfillmentService) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ret := ImportResponse{
+			ContractAddr: ctx.Param("contract_addr"),
+			OfferId:      ctx.Param("redeemable_id"),
+		}
+
+		body, format, err := importBody(ctx)
+		if err != nil {
+			log.Warn("error reading import", "err", err)
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "error reading import", "err": err})
+			return
+		}
+
+		ret.ImportSummary, err = fs.ImportCodes(ret.ContractAddr, ret.OfferId, ctx.Query("url"), format, body)
+		if err != nil {
+			log.Warn("error importing fulfillment data", "err", err)
+			ret.Message, ret.Err = "error importing fulfillment data", err
+			ctx.JSON(statusOf(err), ret)
+			return
+		}
+
+		ret.Message = "imported fulfillment data for a redeemable offer"
+		ctx.JSON(http.StatusOK, ret)
+	}
+}
+
+// importBody returns the rows to import, streamed from the request body or from the `file` part of a multipart form,
+// and their format: the `format` query parameter, or else by the content type or the file name.
+func importBody(ctx *gin.Context) (body io.Reader, format string, err error) {
+	format = ctx.Query("format")
+	body, contentType := ctx.Request.Body, ctx.ContentType()
+
+	if contentType == gin.MIMEMultipartPOSTForm {
+		var reader *multipart.Reader
+		if reader, err = ctx.Request.MultipartReader(); err != nil {
+			return
+		}
+		var part *multipart.Part
+		for part == nil || part.FormName() != "file" {
+			if part, err = reader.NextPart(); err != nil {
+				if err == io.EOF {
+					err = errors.NoTrace("no file part in multipart form", errors.K.Invalid)
+				}
+				return
+			}
+		}
+		body, contentType = part, part.Header.Get("Content-Type")
+		if format == "" {
+			format = db.ImportFormatOf(part.FileName())
+		}
+	}
+
+	if format == "" {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		switch mediaType {
+		case "text/csv":
+			format = db.ImportCSV
+		case "application/x-ndjson", "application/jsonl", "application/x-jsonlines":
+			format = db.ImportJSONL
+		}
+	}
+
+	return
+}
+
+// ExportFulfillmentData godoc
+// @ID offer-redemption-export
+// @Summary Export the unclaimed codes of a redeemable offer
+// @Description Export the unclaimed codes of a redeemable offer
+// @Param network path string true "which ELV network the contract is on: 'main' or 'demov3'.  Only used to look up the contract owner."
+// @Param contract_addr path string true "the contract address of the redeemable offer"
+// @Param redeemable_id path string true "the redeemable offer id"
+// @Produce  json
+// @Router /:network/export/:contact_addr/:redeemable_id [GET]
+func ExportFulfillmentData(fs *server.FulfillmentService) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		contractAddr := ctx.Param("contract_addr")
+		redeemableId := ctx.Param("redeemable_id")
+
+		unclaimed, err := fs.GetUnclaimed(contractAddr, redeemableId)
+		if err != nil {
+			log.Warn("error exporting fulfillment data", "err", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"message": "error exporting fulfillment data",
+				"err":     err,
+			})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, ExportResponse{
+			ContractAddr: contractAddr,
+			OfferId:      redeemableId,
+			Unclaimed:    unclaimed,
+		})
+	}
+}
+
+// GetStats godoc
+// @ID offer-redemption-stats
+// @Summary Inventory of the code pool of a redeemable offer
+// @Description The codes loaded, claimed and remaining, the claims over the last hour, day and week, and the first and
+// @Description last claim times, of the offer, or of each offer of the contract with codes, as `{ "offers": [ ... ] }`.
+// @Param network path string true "which ELV network the contract is on: 'main' or 'demov3'.  Only used to look up the contract owner."
+// @Param contract_addr path string true "the contract address of the redeemable offer"
+// @Param redeemable_id path string false "the redeemable offer id"
+// @Produce  json
+// @Router /:network/stats/:contact_addr/:redeemable_id [GET]
+// @Router /:network/stats/:contact_addr [GET]
+func GetStats(fs *server.FulfillmentService) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		redeemableId := ctx.Param("redeemable_id")
+		stats, err := fs.GetStats(ctx.Param("contract_addr"), redeemableId)
+		if err != nil {
+			log.Warn("error getting offer stats", "err", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"message": "error getting offer stats",
+				"err":     err,
+			})
+			return
+		}
+
+		if redeemableId != "" {
+			ctx.JSON(http.StatusOK, stats[0])
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"offers": stats})
+	}
+}
+
+// PutOffer godoc
+// @ID offer-register
+// @Summary Register a redeemable offer
+// @Description Register a redeemable offer on the network, or update its registration. Redemptions of an offer are
+// @Description only fulfilled while it is registered on the redeeming network, active and within its valid window.
+// @Param network path string true "which ELV network the offer is redeemed on: 'main' or 'demov3'"
+// @Param contract_addr path string true "the contract address of the redeemable offer"
+// @Param redeemable_id path string true "the redeemable offer id"
+// @Param offer_request body OfferRequest true "the offer name, valid window and status"
+// @Produce  json
+// @Router /:network/offers/:contact_addr/:redeemable_id [PUT]
+func PutOffer(fs *server.FulfillmentService) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var err error
+
+		var offerRequest OfferRequest
+		if err = ctx.ShouldBind(&offerRequest); err != nil {
+			log.Warn("error binding request body", "err", err)
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "error binding request body", "err": err})
+			return
+		}
+
+		var offer db.Offer
+		offer, err = fs.PutOffer(db.Offer{
+			ContractAddress: ctx.Param("contract_addr"),
+			OfferId:         ctx.Param("redeemable_id"),
+			Network:         ctx.Param("network"),
+			Name:            offerRequest.Name,
+			ValidFrom:       offerRequest.ValidFrom,
+			ValidUntil:      offerRequest.ValidUntil,
+			Status:          offerRequest.Status,
+		})
+		if err != nil {
+			log.Warn("error registering offer", "err", err)
+			ctx.JSON(statusOf(err), gin.H{
+				"message": "error registering offer",
+				"err":     err,
+			})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, offer)
+	}
+}
+
+// GetOffer godoc
+// @ID offer-get
+// @Summary Get a registered offer
+// @Description Get a registered offer; 404 if not registered
+// @Param network path string true "which ELV network the contract is on: 'main' or 'demov3'.  Only used to look up the contract owner."
+// @Param contract_addr path string true "the contract address of the redeemable offer"
+// @Param redeemable_id path string true "the redeemable offer id"
+// @Produce  json
+// @Router /:network/offers/:contact_addr/:redeemable_id [GET]
+func GetOffer(fs *server.FulfillmentService) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		offer, err := fs.GetOffer(ctx.Param("contract_addr"), ctx.Param("redeemable_id"))
+		if err != nil {
+			log.Debug("error getting offer", "err", err)
+			ctx.JSON(statusOf(err), gin.H{
+				"message": "error getting offer",
+				"err":     err,
+			})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, offer)
+	}
+}
+
+// ListOffers godoc
+// @ID offer-list
+// @Summary List the registered offers of a contract
+// @Description List the registered offers of a contract, on any network
+// @Param network path string true "which ELV network the contract is on: 'main' or 'demov3'.  Only used to look up the contract owner."
+// @Param contract_addr path string true "the contract address of the redeemable offers"
+// @Produce  json
+// @Router /:network/offers/:contact_addr [GET]
+func ListOffers(fs *server.FulfillmentService) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		offers, err := fs.ListOffers(ctx.Param("contract_addr"))
+		if err != nil {
+			log.Warn("error listing offers", "err", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"message": "error listing offers",
+				"err":     err,
+			})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, gin.H{"offers": offers})
+	}
+}
+
+// SetOfferStatus godoc
+// @ID offer-lifecycle
+// @Summary Pause, resume or retire a registered offer
+// @Description A paused offer takes no new claims until resumed; a retired offer never again, and cannot be resumed.
+// @Description Tokens that claimed the offer before can still fetch their earlier fulfillment.
+// @Param network path string true "which ELV network the contract is on: 'main' or 'demov3'.  Only used to look up the contract owner."
+// @Param contract_addr path string true "the contract address of the redeemable offer"
+// @Param redeemable_id path string true "the redeemable offer id"
+// @Produce  json
+// @Router /:network/offers/:contact_addr/:redeemable_id/pause [POST]
+// @Router /:network/offers/:contact_addr/:redeemable_id/resume [POST]
+// @Router /:network/offers/:contact_addr/:redeemable_id/retire [POST]
+func SetOfferStatus(fs *server.FulfillmentService, status string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		offer, err := fs.SetOfferStatus(ctx.Param("contract_addr"), ctx.Param("redeemable_id"), status)
+		if err != nil {
+			log.Warn("error setting offer status", "status", status, "err", err)
+			ctx.JSON(statusOf(err), gin.H{
+				"message": "error setting offer status",
+				"err":     err,
+			})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, offer)
+	}
+}
+
+// statusOf returns the http status of an error of the offer registry or of a load
+func statusOf(err error) int {
+	switch {
+	case errors.IsKind(errors.K.Invalid, err):
+		return http.StatusBadRequest
+	case errors.IsKind(errors.K.NotExist, err):
+		return http.StatusNotFound
+	case errors.IsKind(errors.K.Exist, err):
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+// Status godoc
+// @ID status
+// @Summary Service status for maintenance
+// @Description The storage in use and the available networks
+// @Produce  json
+// @Router /status [GET]
+func Status(s *server.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{
+			"store":        s.Cfg.DbConfig.Store,
+			"networks":     s.FulfillmentService.AvailableNetworks(),
+			"eth_networks": s.Chain.Status(),
+		})
+	}
+}
+
 // FulfillRedeemableOffer godoc
 // @ID offer-redemption
 // @Summary FulfillRedeemableOffer
-// @Description FulfillRedeemableOffer
+// @Description Fulfill each offer redeemed in the transaction, with a status per offer. Responds 200 if any offer was
+// @Description fulfilled (now or before), 400 if none. Redemptions of offers that are not registered, or not claimable
+// @Description now, have the status "offer_unavailable".
 // @Param network path string true "which ELV network to look up transaction: 'main' or 'demov3'"
 // @Param transaction_id path string true "blockchain transaction id that shows the redeemable offer was redeemed"
 // @Produce  json
@@ -154,49 +561,76 @@ func FulfillRedeemableOffer(fs *server.FulfillmentService) gin.HandlerFunc {
 			return
 		}
 
-		var fulfillment db.FulfillmentResponse
-		fulfillment, err = fs.FulfillRedeemableOffer(request)
+		var results []server.FulfillmentResult
+		results, err = fs.FulfillRedeemableOffers(request)
+		var notFinal *db.NotFinalError
+		if errors.As(err, &notFinal) {
+			log.Debug("tx not yet final", "err", err)
+			retryAfter := int(math.Ceil(notFinal.RetryAfter().Seconds()))
+			ctx.Header("Retry-After", strconv.Itoa(retryAfter))
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{
+				"message":            "transaction not yet final",
+				"confirmations":      notFinal.Confirmations,
+				"min_confirmations":  notFinal.MinConfirmations,
+				"retry_after_blocks": notFinal.RetryAfterBlocks(),
+				"err":                err,
+			})
+			return
+		}
+		if errors.IsKind(errors.K.Unavailable, err) {
+			log.Warn("network unavailable", "network", request.Network, "err", err)
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{
+				"message": "network unavailable",
+				"network": request.Network,
+				"state":   fs.NetworkState(request.Network),
+				"err":     err,
+			})
+			return
+		}
 		if err != nil {
 			log.Debug("error fulfilling offer", "err", err)
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"message": "error fulfilling offer",
+				"err":     err,
+			})
+			return
+		}
 
-			redeemed, getErr := fs.GetRedeemableOffer(fulfillment.ContractAddr, fulfillment.OfferId, fulfillment.TokenId)
-			log.Trace("GetRedeemableOffer", "redeemed", redeemed, "getErr", getErr)
-
-			if redeemed.Claimed {
-				log.Debug("already redeemed offer")
-				ret := FulfillmentResponse{
-					Message: "already fulfilled redeemable offer",
-					FulfillmentData: struct {
-						Url  string `json:"url"`
-						Code string `json:"code"`
-					}{
-						Url:  redeemed.Url,
-						Code: redeemed.Code,
-					},
-					Transaction: fulfillment.ToTransaction(),
-				}
-				ctx.JSON(http.StatusOK, ret)
-				return
-			} else {
-				ctx.JSON(http.StatusBadRequest, gin.H{
-					"message": "error fulfilling offer",
-					"err":     err,
-				})
-				return
+		ret := FulfillmentResponse{Fulfillments: make([]FulfillmentItem, 0, len(results))}
+		succeeded := 0
+		for _, res := range results {
+			item := FulfillmentItem{Transaction: res.Transaction}
+			var unavailable *db.OfferUnavailableError
+			switch {
+			case errors.As(res.Err, &unavailable):
+				log.Debug("offer not available", "tx", res.Transaction, "err", res.Err)
+				item.Status, item.Message, item.Err = StatusOfferUnavailable, "offer not available", res.Err
+			case res.Err != nil:
+				log.Debug("error fulfilling offer", "tx", res.Transaction, "err", res.Err)
+				item.Status, item.Message, item.Err = StatusFailed, "error fulfilling offer", res.Err
+			case res.AlreadyFulfilled:
+				log.Debug("already redeemed offer", "tx", res.Transaction)
+				item.Status, item.Message = StatusAlreadyFulfilled, "already fulfilled redeemable offer"
+				item.FulfillmentData = res.Fulfillment.FulfillmentData()
+				succeeded++
+			default:
+				item.Status, item.Message = StatusFulfilled, "fulfilled redeemable offer"
+				item.FulfillmentData = res.Fulfillment.FulfillmentData()
+				succeeded++
 			}
+			ret.Fulfillments = append(ret.Fulfillments, item)
 		}
 
-		ret := FulfillmentResponse{
-			Message: "fulfilled redeemable offer",
-			FulfillmentData: struct {
-				Url  string `json:"url"`
-				Code string `json:"code"`
-			}{
-				Url:  fulfillment.Url,
-				Code: fulfillment.Code,
-			},
-			Transaction: fulfillment.ToTransaction(),
+		switch {
+		case succeeded == len(results):
+			ret.Message = "fulfilled redeemable offers"
+			ctx.JSON(http.StatusOK, ret)
+		case succeeded > 0:
+			ret.Message = "partially fulfilled redeemable offers"
+			ctx.JSON(http.StatusOK, ret)
+		default:
+			ret.Message = "error fulfilling offers"
+			ctx.JSON(http.StatusBadRequest, ret)
 		}
-		ctx.JSON(http.StatusOK, ret)
 	}
 }
@@ -1,4 +1,7 @@
 
+# requires an env var with a token signed by an admin of the contracts:
+#  export tok=acspjc...
+
 # demov3 NFT w/ offer: Goat One on demov3
 contract=0xb914ad493a0a4fe5a899dc21b66a509bcf8f1ed9
 
@@ -12,20 +15,26 @@ contract4=0xd4c8153372b0292b364dac40d0ade37da4c4869a
 # prod
 #prefix=https://appsvc.svc.eluv.io/main/code-fulfillment
 # testing
-prefix=http://localhost:2023/dv3/
+prefix=http://localhost:2024/demov3
 
-for i in {1..3}
+# codes are only fulfilled for registered offers
+for c in $contract $contract2 $contract3 $contract4
 do
-  code=`echo $RANDOM | base64 | tr -d =`
-
-  for c in $contract $contract2 $contract3 $contract4
+  for o in 0 1
   do
-    curl -s -X POST -H "Content-Type: application/json" \
-      -d '{ "url": "https://eluv.io/vouncher-redeem", "codes":  [ "'0$code'" ] }' \
-          $prefix/load/$c/0
-    curl -s -X POST -H "Content-Type: application/json" \
-      -d '{ "url": "https://eluv.io/vouncher-redeem", "codes":  [ "'1$code'" ] }' \
-          $prefix/load/$c/1
+    curl -s -X PUT -H "Content-Type: application/json" -H "Authorization: Bearer $tok" -d '{}' $prefix/offers/$c/$o
   done
+done
 
+# one csv of random codes per offer, imported in a single request each
+codes=3
+for c in $contract $contract2 $contract3 $contract4
+do
+  for o in 0 1
+  do
+    ( echo code
+      for i in $(seq $codes); do echo "$o$(echo $RANDOM | base64 | tr -d =)"; done
+    ) | curl -s -X POST -H "Content-Type: text/csv" -H "Authorization: Bearer $tok" --data-binary @- \
+          "$prefix/import/$c/$o?url=https://eluv.io/vouncher-redeem"
+  done
 done
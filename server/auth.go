@@ -0,0 +1,37 @@
+package server
+
+import (
+	"fulfillmentd/utils"
+	"github.com/eluv-io/errors-go"
+	"strings"
+)
+
+// AuthorizeAdmin returns nil if `signer` may administer `contractAddr` on `network`: it is configured as an admin of
+// all contracts or of this contract, or it is the contract owner on chain and admin.allow_contract_owner is set. With
+// no `contractAddr`, only admins of all contracts are authorized.
+func (fs *FulfillmentService) AuthorizeAdmin(network, contractAddr, signer string) (err error) {
+	e := errors.TemplateNoTrace("AuthorizeAdmin", errors.K.Permission, "contract_addr", contractAddr, "signer", signer)
+
+	signer = strings.ToLower(signer)
+	if utils.ArrayContains(fs.admin.Addresses, signer) ||
+		utils.ArrayContains(fs.admin.ContractAddresses[strings.ToLower(contractAddr)], signer) {
+		return nil
+	}
+
+	if !fs.admin.AllowContractOwner || contractAddr == "" {
+		return e("reason", "not an admin")
+	}
+	if !utils.ArrayContains(fs.AvailableNetworks(), network) {
+		return e("reason", "not an admin; cannot check contract owner on invalid network", "network", network)
+	}
+
+	var owner string
+	if owner, err = fs.db.ContractOwner(network, contractAddr); err != nil {
+		return e(err, "reason", "cannot get contract owner", "network", network)
+	}
+	if owner != signer {
+		return e("reason", "not an admin or the contract owner", "owner", owner)
+	}
+
+	return nil
+}
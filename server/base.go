@@ -1,8 +1,11 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"fulfillmentd/server/config"
 	"fulfillmentd/server/db"
+	"fulfillmentd/server/eth"
 	lg "github.com/eluv-io/log-go"
 	"github.com/gin-gonic/gin"
 	"net/http"
@@ -12,6 +15,7 @@ var log = lg.Get("/fs/server")
 
 type Server struct {
 	http        *http.Server
+	adminHttp   *http.Server
 	Router      *gin.Engine
 	AdminRouter *gin.Engine
 	middleware  struct {
@@ -21,6 +25,7 @@ type Server struct {
 
 	Cfg               *config.AuthorityConfig
 	ConnectionManager *db.ConnectionManager
+	Chain             eth.Backends // eth backends of the networks; a fake chain in tests
 
 	FulfillmentService *FulfillmentService
 }
@@ -42,6 +47,10 @@ func ConnectDb(cfg *config.AuthorityConfig) (s *Server, err error) {
 	log.Info("StartServer", "DbConfig", cfg.DbConfig)
 	s = &Server{Cfg: cfg}
 
+	if cfg.DbConfig.Store == config.StoreMemory {
+		return s, nil
+	}
+
 	if s.ConnectionManager, err = db.NewConnectionManager(cfg.DbConfig); err != nil {
 		log.Error("error connecting", err)
 		return
@@ -50,6 +59,69 @@ func ConnectDb(cfg *config.AuthorityConfig) (s *Server, err error) {
 	return s, nil
 }
 
+// ConnectEth creates the eth clients of every network and starts their health checks.
+func (s *Server) ConnectEth() {
+	clients := eth.NewClientManager(s.Cfg.EthConfig, s.Cfg.Networks)
+	clients.Start()
+	s.Chain = clients
+}
+
+// Serve starts the public and admin listeners. A listener that fails sends its error on the returned channel; one
+// stopped by Shutdown sends nil.
+func (s *Server) Serve() <-chan error {
+	s.http = &http.Server{
+		Addr:    fmt.Sprintf(":%d", s.Cfg.Port),
+		Handler: s.Router,
+	}
+	s.adminHttp = &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", s.Cfg.AdminBind, s.Cfg.AdminPort),
+		Handler: s.AdminRouter,
+	}
+
+	errs := make(chan error, 2)
+	for _, srv := range []*http.Server{s.http, s.adminHttp} {
+		go func(srv *http.Server) {
+			log.Info("listening", "addr", srv.Addr)
+			err := srv.ListenAndServe()
+			if err == http.ErrServerClosed {
+				err = nil
+			}
+			errs <- err
+		}(srv)
+	}
+
+	return errs
+}
+
+// Shutdown stops accepting requests and waits for in-flight requests to complete until `ctx` is done, then closes the
+// database connections and eth clients. It returns the context error if requests were still in flight at the deadline.
+func (s *Server) Shutdown(ctx context.Context) (err error) {
+	for _, srv := range []*http.Server{s.http, s.adminHttp} {
+		if srv == nil {
+			continue
+		}
+		if e := srv.Shutdown(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	s.Close()
+
+	return
+}
+
+// Close stops the low-inventory alerts, and releases the database connections and eth clients.
+func (s *Server) Close() {
+	if s.FulfillmentService != nil {
+		s.FulfillmentService.Close()
+	}
+	if s.ConnectionManager != nil {
+		s.ConnectionManager.Close()
+	}
+	if s.Chain != nil {
+		s.Chain.Close()
+	}
+}
+
 func NewGroup(routes ...*Route) *group {
 	g := &group{basePath: ""}
 	g.routes = append(g.routes, routes...)
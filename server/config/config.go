@@ -1,6 +1,14 @@
 package config
 
+import "time"
+
+const (
+	StoreCockroach = "cockroach"
+	StoreMemory    = "memory"
+)
+
 type DbConfig struct {
+	Store         string // cockroach, memory
 	Username      string
 	Password      string
 	Host          string
@@ -15,8 +23,67 @@ type DbConfig struct {
 	SSLRootCert   string
 }
 
+// AdminConfig lists who may call the admin APIs, by signer address of the bearer token.
+type AdminConfig struct {
+	Addresses          []string            // admins of all contracts
+	ContractAddresses  map[string][]string // admins by contract address
+	AllowContractOwner bool                // the on-chain owner of a contract is its admin
+}
+
+// NetworkConfig holds the fabric config url of a network from [elv.networks], and its optional settings from
+// [elv.settings.<network>].
+type NetworkConfig struct {
+	ConfigUrl        string        // fabric config listing the network's ethereum_api endpoints
+	EthUrls          []string      // eth endpoints used instead of those of the config url, if set
+	RedeemContracts  []string      // contracts whose Redeem events are fulfilled; any contract if empty
+	MinConfirmations uint64        // blocks, including the transaction's, before a redemption is fulfilled
+	BlockTime        time.Duration // expected time between blocks, to tell clients when to retry
+}
+
+// EthConfig holds the eth client settings from [eth].
+type EthConfig struct {
+	CallTimeout          time.Duration // timeout of a call to one eth endpoint
+	HealthCheckInterval  time.Duration // between health checks of every endpoint; none if zero
+	EjectionBackoff      time.Duration // an endpoint is ejected this long after a failure, doubling with each failure
+	MaxEjectionBackoff   time.Duration
+	ResolveRetryInterval time.Duration // between attempts to get the endpoints of a network from its config url
+	RefreshInterval      time.Duration // between refreshes of the endpoints of a network from its config url; none if zero
+}
+
+// PolicyConfig holds the optional fulfillment policies from [policy], by offer: "<contract>/<offer id>", or
+// "<contract>/*" for all offers of a contract.
+type PolicyConfig struct {
+	VerifyOwnership []string // offers whose redeemer must still own the token, and the offer be redeemed on chain
+}
+
+// SimulationConfig enables the sandbox mode from [simulation], resolving transactions from a fixture file of fake
+// receipts instead of the chain.
+type SimulationConfig struct {
+	Enabled  bool
+	Fixtures string // path of the fixture file
+}
+
+// AlertConfig holds the low-inventory alerts from [alerts]: a signed webhook is posted once when the remaining codes
+// of an offer fall to one of its thresholds, and again only after a restock above it. No alerts without a webhook url.
+type AlertConfig struct {
+	WebhookUrl    string
+	WebhookSecret string              // HMAC-SHA256 key of the webhook signature
+	Timeout       time.Duration       // of one webhook attempt
+	MaxAttempts   int                 // webhook attempts, retrying failures
+	RetryBackoff  time.Duration       // before the first retry, doubling with each retry
+	Thresholds    map[string][]string // by offer, "<contract>/<offer id>" or "<contract>/*": remaining codes "N", or "N%" of those loaded
+}
+
 type AuthorityConfig struct {
-	DbConfig         DbConfig
-	Port             int
-	EthUrlsByNetwork map[string]string
+	DbConfig        DbConfig
+	AdminConfig     AdminConfig
+	Port            int
+	AdminPort       int    // listener for the admin APIs
+	AdminBind       string // admin listener bind address; "127.0.0.1" for localhost-only, "" for all interfaces
+	ShutdownTimeout time.Duration
+	EthConfig       EthConfig
+	Networks        map[string]NetworkConfig
+	Policy          PolicyConfig
+	Simulation      SimulationConfig
+	Alerts          AlertConfig
 }
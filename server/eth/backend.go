@@ -0,0 +1,39 @@
+package eth
+
+import (
+	"context"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Backend is the part of an eth client the daemon uses: resolving transactions and calling contracts. It is
+// implemented by ethclient.Client, and by ethtest.FakeChain for tests.
+type Backend interface {
+	bind.ContractCaller
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+	TransactionByHash(ctx context.Context, hash common.Hash) (tx *types.Transaction, isPending bool, err error)
+	BlockNumber(ctx context.Context) (uint64, error)
+}
+
+// CallFunc makes calls on the backend of a network; `ctx` carries the per-call timeout.
+type CallFunc func(ctx context.Context, backend Backend) error
+
+// Backends provides the eth backend of each network. It is implemented by ClientManager, and by ethtest.FakeChain
+// for tests.
+type Backends interface {
+	// Networks returns the names of the configured networks.
+	Networks() []string
+
+	// State returns the state of `network`: one of StateResolving, StateUp or StateDown.
+	State(network string) string
+
+	// Status returns the state of each network and its endpoints.
+	Status() map[string]NetworkStatus
+
+	// Do calls `fn` with the backend of `network`.
+	Do(network string, fn CallFunc) error
+
+	// Close releases the backends.
+	Close()
+}
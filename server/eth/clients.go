@@ -0,0 +1,475 @@
+package eth
+
+import (
+	"context"
+	"fulfillmentd/server/config"
+	"fulfillmentd/utils"
+	"github.com/eluv-io/errors-go"
+	elog "github.com/eluv-io/log-go"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var log = elog.Get("/fs/eth")
+
+// Network states
+const (
+	StateResolving = "resolving" // the endpoints are not yet resolved from the network's config url
+	StateUp        = "up"        // at least one endpoint is active
+	StateDown      = "down"      // every endpoint is ejected
+)
+
+// ClientManager keeps reusable eth clients for every endpoint of each network. Calls are spread round-robin over the
+// active endpoints; an endpoint that is unreachable is ejected, with exponential backoff, and the call fails over to the
+// next one.
+//
+// The endpoints of a network are the eth_urls of its settings, or else resolved from its fabric config url in the
+// background, retrying until the config url is reachable, so that one network being down does not affect the others.
+// Resolved endpoints are refreshed from the config url each refresh_interval.
+type ClientManager struct {
+	cfg      config.EthConfig
+	networks map[string]*network
+	stop     chan struct{}
+	done     sync.WaitGroup
+}
+
+type network struct {
+	configUrl  string
+	fixed      bool // endpoints set by eth_urls rather than resolved from configUrl
+	mutex      sync.Mutex
+	endpoints  []*endpoint
+	next       int       // round-robin position in endpoints
+	resolveErr error     // last error resolving the endpoints from configUrl
+	resolved   time.Time // last time the endpoints were resolved from configUrl
+	changes    int       // number of times resolving changed the endpoints
+}
+
+type endpoint struct {
+	url          string
+	client       *ethclient.Client // nil until dialed, and again after a failure
+	failures     int               // consecutive failures
+	ejectedUntil time.Time         // not used before then, unless no endpoint is active
+	lastErr      error
+}
+
+// EndpointStatus reports the state of one eth endpoint.
+type EndpointStatus struct {
+	Url          string     `json:"url"`
+	Active       bool       `json:"active"`
+	Failures     int        `json:"failures"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+}
+
+// NetworkStatus reports the state of a network and its eth endpoints.
+type NetworkStatus struct {
+	State           string           `json:"state"`
+	ConfigUrl       string           `json:"config_url,omitempty"`
+	Endpoints       []EndpointStatus `json:"endpoints"`
+	LastResolved    *time.Time       `json:"last_resolved,omitempty"`
+	EndpointChanges int              `json:"endpoint_changes"`
+	LastError       string           `json:"last_error,omitempty"`
+}
+
+func NewClientManager(cfg config.EthConfig, networks map[string]config.NetworkConfig) *ClientManager {
+	m := &ClientManager{
+		cfg:      cfg,
+		networks: make(map[string]*network),
+		stop:     make(chan struct{}),
+	}
+	for net, netCfg := range networks {
+		n := &network{configUrl: netCfg.ConfigUrl, fixed: len(netCfg.EthUrls) > 0}
+		n.setEndpoints(netCfg.EthUrls)
+		m.networks[net] = n
+		log.Info("init eth network", "network", net, "eth_urls", netCfg.EthUrls, "config_url", netCfg.ConfigUrl)
+	}
+
+	return m
+}
+
+// Networks returns the names of the configured networks.
+func (m *ClientManager) Networks() []string {
+	return utils.Keys(m.networks)
+}
+
+// Status returns the state of each network and its endpoints.
+func (m *ClientManager) Status() map[string]NetworkStatus {
+	status := make(map[string]NetworkStatus, len(m.networks))
+	for net, n := range m.networks {
+		status[net] = n.status()
+	}
+	return status
+}
+
+// State returns the state of `network`: one of StateResolving, StateUp or StateDown.
+func (m *ClientManager) State(network string) string {
+	n, ok := m.networks[network]
+	if !ok {
+		return ""
+	}
+	return n.status().State
+}
+
+// Do calls `fn` with a client for `network`, trying each endpoint in turn: the active endpoints round-robin, then the
+// ejected ones as a last resort. It only moves on to the next endpoint if the call failed because the endpoint is
+// unreachable or timed out; other errors are returned as is.
+func (m *ClientManager) Do(network string, fn CallFunc) (err error) {
+	n, ok := m.networks[network]
+	if !ok {
+		err = errors.NoTrace("unknown network", errors.K.Invalid, "network", network)
+		return
+	}
+
+	candidates := n.candidates()
+	if len(candidates) == 0 {
+		err = errors.NoTrace("network unavailable", errors.K.Unavailable, n.resolveError(), "network", network,
+			"state", StateResolving)
+		return
+	}
+	for _, ep := range candidates {
+		var ec *ethclient.Client
+		if ec, err = n.connect(ep); err != nil {
+			n.fail(ep, err, m.cfg)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), m.cfg.CallTimeout)
+		err = fn(ctx, ec)
+		cancel()
+		if err == nil || !isEndpointFailure(err) {
+			n.succeed(ep)
+			return
+		}
+		log.Warn("eth endpoint failed", "network", network, "url", ep.url, "err", err)
+		n.fail(ep, err, m.cfg)
+	}
+
+	err = errors.NoTrace("no eth endpoint available", errors.K.Unavailable, err, "network", network)
+	return
+}
+
+// Start resolves and refreshes the endpoints of networks from their config url, and checks the health of every
+// endpoint each health_check_interval in the background until Close, reinstating ejected endpoints that respond again
+// once their backoff is over.
+func (m *ClientManager) Start() {
+	for net, n := range m.networks {
+		if !n.fixed && n.configUrl != "" {
+			m.done.Add(1)
+			go m.resolve(net, n)
+		}
+	}
+
+	if m.cfg.HealthCheckInterval <= 0 {
+		return
+	}
+	m.done.Add(1)
+	go func() {
+		defer m.done.Done()
+		ticker := time.NewTicker(m.cfg.HealthCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				m.checkHealth()
+			}
+		}
+	}()
+}
+
+// Close stops the health checks and closes every client.
+func (m *ClientManager) Close() {
+	close(m.stop)
+	m.done.Wait()
+	for _, n := range m.networks {
+		n.mutex.Lock()
+		for _, ep := range n.endpoints {
+			if ep.client != nil {
+				ep.client.Close()
+				ep.client = nil
+			}
+		}
+		n.mutex.Unlock()
+	}
+}
+
+// resolve gets the endpoints of `n` from its config url, retrying every resolve_retry_interval until it succeeds, then
+// refreshes them every refresh_interval, until the manager is closed. A failed refresh keeps the current endpoints.
+func (m *ClientManager) resolve(net string, n *network) {
+	defer m.done.Done()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), m.cfg.CallTimeout)
+		go func() {
+			select {
+			case <-m.stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		urls, err := fetchEthUrls(ctx, n.configUrl)
+		cancel()
+
+		wait := m.cfg.RefreshInterval
+		if err == nil {
+			if added, removed := n.updateEndpoints(urls); len(added) > 0 || len(removed) > 0 {
+				log.Info("eth endpoints changed", "network", net, "added", added, "removed", removed, "urls", urls)
+			} else {
+				log.Debug("eth endpoints unchanged", "network", net, "urls", urls)
+			}
+		} else {
+			n.setResolveError(err)
+			if wait <= 0 || len(n.all()) == 0 {
+				wait = m.cfg.ResolveRetryInterval
+			}
+			log.Warn("cannot resolve eth endpoints", "network", net, "config_url", n.configUrl, "err", err,
+				"retry_in", wait)
+		}
+		if wait <= 0 {
+			return
+		}
+
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// checkHealth gets the chain head from every endpoint not in its ejection backoff, ejecting or reinstating it.
+func (m *ClientManager) checkHealth() {
+	now := time.Now()
+	for net, n := range m.networks {
+		for _, ep := range n.all() {
+			if n.ejected(ep, now) {
+				continue
+			}
+			ec, err := n.connect(ep)
+			if err == nil {
+				ctx, cancel := context.WithTimeout(context.Background(), m.cfg.CallTimeout)
+				_, err = ec.BlockNumber(ctx)
+				cancel()
+			}
+			if err != nil {
+				log.Warn("eth endpoint unhealthy", "network", net, "url", ep.url, "err", err)
+				n.fail(ep, err, m.cfg)
+				continue
+			}
+			n.succeed(ep)
+		}
+	}
+}
+
+// candidates returns the endpoints in the order to try them: the active ones round-robin, then the ejected ones by
+// end of their backoff.
+func (n *network) candidates() []*endpoint {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	now := time.Now()
+	active := make([]*endpoint, 0, len(n.endpoints))
+	var ejected []*endpoint
+	for i := range n.endpoints {
+		ep := n.endpoints[(n.next+i)%len(n.endpoints)]
+		if ep.active(now) {
+			active = append(active, ep)
+		} else {
+			ejected = append(ejected, ep)
+		}
+	}
+	if len(n.endpoints) > 0 {
+		n.next = (n.next + 1) % len(n.endpoints)
+	}
+	sort.SliceStable(ejected, func(i, j int) bool {
+		return ejected[i].ejectedUntil.Before(ejected[j].ejectedUntil)
+	})
+
+	return append(active, ejected...)
+}
+
+// setEndpoints sets the endpoints of `n` to `urls`.
+func (n *network) setEndpoints(urls []string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.endpoints = make([]*endpoint, 0, len(urls))
+	for _, url := range urls {
+		n.endpoints = append(n.endpoints, &endpoint{url: url})
+	}
+	n.next, n.resolveErr = 0, nil
+}
+
+// updateEndpoints swaps the endpoints of `n` for `urls`, resolved from its config url. Endpoints that remain keep their
+// client and ejection state; the clients of removed endpoints are closed.
+func (n *network) updateEndpoints(urls []string) (added, removed []string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	current := make(map[string]*endpoint, len(n.endpoints))
+	for _, ep := range n.endpoints {
+		current[ep.url] = ep
+	}
+	endpoints := make([]*endpoint, 0, len(urls))
+	for _, url := range urls {
+		if ep, ok := current[url]; ok {
+			endpoints = append(endpoints, ep)
+			delete(current, url)
+		} else {
+			endpoints = append(endpoints, &endpoint{url: url})
+			added = append(added, url)
+		}
+	}
+	for url, ep := range current {
+		removed = append(removed, url)
+		if ep.client != nil {
+			ep.client.Close()
+			ep.client = nil
+		}
+	}
+
+	if len(added) > 0 || len(removed) > 0 {
+		n.endpoints, n.next = endpoints, 0
+		n.changes++
+	}
+	n.resolveErr, n.resolved = nil, time.Now()
+
+	return
+}
+
+func (n *network) setResolveError(err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.resolveErr = err
+}
+
+func (n *network) resolveError() error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.resolveErr
+}
+
+func (n *network) status() NetworkStatus {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	now := time.Now()
+	st := NetworkStatus{State: StateDown, ConfigUrl: n.configUrl, Endpoints: make([]EndpointStatus, 0, len(n.endpoints))}
+	if len(n.endpoints) == 0 {
+		st.State = StateResolving
+	}
+	if n.resolveErr != nil {
+		st.LastError = n.resolveErr.Error()
+	}
+	if !n.resolved.IsZero() {
+		resolved := n.resolved
+		st.LastResolved, st.EndpointChanges = &resolved, n.changes
+	}
+	for _, ep := range n.endpoints {
+		es := EndpointStatus{Url: ep.url, Active: ep.active(now), Failures: ep.failures}
+		if es.Active {
+			st.State = StateUp
+		} else {
+			until := ep.ejectedUntil
+			es.EjectedUntil = &until
+		}
+		if ep.lastErr != nil {
+			es.LastError = ep.lastErr.Error()
+		}
+		st.Endpoints = append(st.Endpoints, es)
+	}
+
+	return st
+}
+
+// all returns the endpoints in configured order.
+func (n *network) all() []*endpoint {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return append([]*endpoint(nil), n.endpoints...)
+}
+
+func (n *network) ejected(ep *endpoint, now time.Time) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return !ep.active(now)
+}
+
+// connect returns the client of `ep`, dialing it if needed.
+func (n *network) connect(ep *endpoint) (ec *ethclient.Client, err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if ep.client == nil {
+		if ep.client, err = ethclient.Dial(ep.url); err != nil {
+			return
+		}
+	}
+	ec = ep.client
+
+	return
+}
+
+// succeed reinstates `ep` if it was ejected.
+func (n *network) succeed(ep *endpoint) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if ep.failures > 0 {
+		log.Info("eth endpoint reinstated", "url", ep.url, "failures", ep.failures)
+	}
+	ep.failures, ep.ejectedUntil, ep.lastErr = 0, time.Time{}, nil
+}
+
+// fail ejects `ep` for a backoff that doubles with each consecutive failure, and drops its client, so that it is dialed
+// again on next use.
+func (n *network) fail(ep *endpoint, err error, cfg config.EthConfig) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	ep.failures++
+	ep.lastErr = err
+	backoff := cfg.EjectionBackoff
+	for i := 1; i < ep.failures && backoff < cfg.MaxEjectionBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > cfg.MaxEjectionBackoff {
+		backoff = cfg.MaxEjectionBackoff
+	}
+	ep.ejectedUntil = time.Now().Add(backoff)
+	log.Info("eth endpoint ejected", "url", ep.url, "failures", ep.failures, "backoff", backoff)
+
+	if ep.client != nil {
+		ep.client.Close()
+		ep.client = nil
+	}
+}
+
+func (ep *endpoint) active(now time.Time) bool {
+	return !now.Before(ep.ejectedUntil)
+}
+
+// isEndpointFailure tells whether `err` is due to the endpoint rather than the call, e.g. a connection or timeout error.
+func isEndpointFailure(err error) bool {
+	var netErr net.Error
+	var httpErr rpc.HTTPError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.As(err, &netErr):
+		return true
+	case errors.As(err, &httpErr):
+		return httpErr.StatusCode >= 500 || httpErr.StatusCode == 429
+	}
+	return false
+}
@@ -0,0 +1,399 @@
+package eth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"fulfillmentd/server/config"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testNetwork = "main"
+
+// endpoint modes of an rpcServer
+const (
+	modeUp        int32 = iota // answers eth_blockNumber with its number
+	modeDown                   // fails with a 503
+	modeSlow                   // never answers before the call times out
+	modeRejecting              // answers with a JSON-RPC error, as for an invalid call
+)
+
+// rpcServer is a JSON-RPC eth endpoint answering eth_blockNumber with its own number, so that tests can tell which
+// endpoint served a call.
+type rpcServer struct {
+	*httptest.Server
+	number uint64
+	mode   int32
+	calls  int32
+}
+
+func newRPCServer(t *testing.T, number uint64) *rpcServer {
+	s := &rpcServer{number: number}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.calls, 1)
+		var req struct {
+			Id     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.Id}
+		switch atomic.LoadInt32(&s.mode) {
+		case modeDown:
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		case modeSlow:
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		case modeRejecting:
+			resp["error"] = map[string]interface{}{"code": -32000, "message": "rejected"}
+		default:
+			if req.Method != "eth_blockNumber" {
+				resp["error"] = map[string]interface{}{"code": -32601, "message": "unsupported " + req.Method}
+			} else {
+				resp["result"] = fmt.Sprintf("0x%x", s.number)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *rpcServer) setMode(mode int32) {
+	atomic.StoreInt32(&s.mode, mode)
+}
+
+func (s *rpcServer) callCount() int {
+	return int(atomic.LoadInt32(&s.calls))
+}
+
+func testEthConfig() config.EthConfig {
+	return config.EthConfig{
+		CallTimeout:          200 * time.Millisecond,
+		EjectionBackoff:      time.Minute,
+		MaxEjectionBackoff:   time.Hour,
+		ResolveRetryInterval: 10 * time.Millisecond,
+		RefreshInterval:      10 * time.Millisecond,
+	}
+}
+
+func newTestManager(t *testing.T, cfg config.EthConfig, servers ...*rpcServer) *ClientManager {
+	var urls []string
+	for _, s := range servers {
+		urls = append(urls, s.URL)
+	}
+	m := NewClientManager(cfg, map[string]config.NetworkConfig{testNetwork: {EthUrls: urls}})
+	t.Cleanup(m.Close)
+	return m
+}
+
+// blockNumber calls eth_blockNumber on `network`, returning the number of the endpoint that answered
+func blockNumber(m *ClientManager, network string) (number uint64, err error) {
+	err = m.Do(network, func(ctx context.Context, backend Backend) (err error) {
+		number, err = backend.BlockNumber(ctx)
+		return
+	})
+	return
+}
+
+// endpointStatus returns the status of the endpoint of `network` with `url`
+func endpointStatus(t *testing.T, m *ClientManager, network, url string) EndpointStatus {
+	t.Helper()
+	for _, es := range m.Status()[network].Endpoints {
+		if es.Url == url {
+			return es
+		}
+	}
+	t.Fatalf("no endpoint %s in %+v", url, m.Status()[network])
+	return EndpointStatus{}
+}
+
+// waitFor polls `cond` until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	servers := []*rpcServer{newRPCServer(t, 1), newRPCServer(t, 2), newRPCServer(t, 3)}
+	m := newTestManager(t, testEthConfig(), servers...)
+
+	var got []uint64
+	for i := 0; i < 6; i++ {
+		number, err := blockNumber(m, testNetwork)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, number)
+	}
+	if want := []uint64{1, 2, 3, 1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("endpoints %v, want %v", got, want)
+	}
+
+	if _, err := blockNumber(m, "unknown"); err == nil {
+		t.Error("call on an unknown network")
+	}
+}
+
+func TestEjectionBackoff(t *testing.T) {
+	cfg := config.EthConfig{EjectionBackoff: 10 * time.Second, MaxEjectionBackoff: 60 * time.Second}
+	n := &network{}
+	n.setEndpoints([]string{"http://localhost:1"})
+	ep := n.endpoints[0]
+
+	for i, want := range []time.Duration{10, 20, 40, 60, 60} {
+		want *= time.Second
+		before := time.Now()
+		n.fail(ep, context.DeadlineExceeded, cfg)
+		if backoff := ep.ejectedUntil.Sub(before); backoff < want || backoff > want+time.Second {
+			t.Errorf("failure %d: backoff %s, want %s", i+1, backoff, want)
+		}
+		if n.status().State != StateDown {
+			t.Errorf("failure %d: state %s, want %s", i+1, n.status().State, StateDown)
+		}
+	}
+
+	n.succeed(ep)
+	if ep.failures != 0 || !ep.active(time.Now()) || n.status().State != StateUp {
+		t.Errorf("not reinstated: %+v", n.status())
+	}
+	before := time.Now()
+	n.fail(ep, context.DeadlineExceeded, cfg)
+	if backoff := ep.ejectedUntil.Sub(before); backoff > 11*time.Second {
+		t.Errorf("backoff %s after reinstatement, want %s", backoff, cfg.EjectionBackoff)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	t.Run("down", func(t *testing.T) {
+		down, up := newRPCServer(t, 1), newRPCServer(t, 2)
+		down.setMode(modeDown)
+		m := newTestManager(t, testEthConfig(), down, up)
+
+		for i := 0; i < 3; i++ {
+			if number, err := blockNumber(m, testNetwork); err != nil || number != 2 {
+				t.Fatalf("call %d: endpoint %d, %v", i, number, err)
+			}
+		}
+		// ejected after the first call, and not tried again during its backoff
+		if calls := down.callCount(); calls != 1 {
+			t.Errorf("%d calls on the ejected endpoint, want 1", calls)
+		}
+		if es := endpointStatus(t, m, testNetwork, down.URL); es.Active || es.Failures != 1 || es.LastError == "" {
+			t.Errorf("endpoint down: %+v", es)
+		}
+		if m.State(testNetwork) != StateUp {
+			t.Errorf("state %s, want %s", m.State(testNetwork), StateUp)
+		}
+	})
+
+	t.Run("slow", func(t *testing.T) {
+		slow, up := newRPCServer(t, 1), newRPCServer(t, 2)
+		slow.setMode(modeSlow)
+		m := newTestManager(t, testEthConfig(), slow, up)
+
+		start := time.Now()
+		if number, err := blockNumber(m, testNetwork); err != nil || number != 2 {
+			t.Fatalf("endpoint %d, %v", number, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("failover after %s", elapsed)
+		}
+		if es := endpointStatus(t, m, testNetwork, slow.URL); es.Active {
+			t.Errorf("slow endpoint not ejected: %+v", es)
+		}
+	})
+
+	t.Run("call error", func(t *testing.T) {
+		rejecting, up := newRPCServer(t, 1), newRPCServer(t, 2)
+		rejecting.setMode(modeRejecting)
+		m := newTestManager(t, testEthConfig(), rejecting, up)
+
+		// an error of the call itself is returned as is, without trying the next endpoint
+		if _, err := blockNumber(m, testNetwork); err == nil || isEndpointFailure(err) {
+			t.Errorf("error %v, want the call error", err)
+		}
+		if up.callCount() != 0 {
+			t.Errorf("failed over on a call error")
+		}
+		if es := endpointStatus(t, m, testNetwork, rejecting.URL); !es.Active || es.Failures != 0 {
+			t.Errorf("endpoint ejected on a call error: %+v", es)
+		}
+	})
+
+	t.Run("all down", func(t *testing.T) {
+		down := []*rpcServer{newRPCServer(t, 1), newRPCServer(t, 2)}
+		for _, s := range down {
+			s.setMode(modeDown)
+		}
+		m := newTestManager(t, testEthConfig(), down...)
+
+		if _, err := blockNumber(m, testNetwork); err == nil {
+			t.Fatal("call with every endpoint down")
+		}
+		if m.State(testNetwork) != StateDown {
+			t.Errorf("state %s, want %s", m.State(testNetwork), StateDown)
+		}
+
+		// ejected endpoints are still tried as a last resort, and reinstated when they answer
+		down[1].setMode(modeUp)
+		if number, err := blockNumber(m, testNetwork); err != nil || number != 2 {
+			t.Fatalf("endpoint %d, %v", number, err)
+		}
+		if es := endpointStatus(t, m, testNetwork, down[1].URL); !es.Active || es.Failures != 0 {
+			t.Errorf("endpoint not reinstated: %+v", es)
+		}
+		if m.State(testNetwork) != StateUp {
+			t.Errorf("state %s, want %s", m.State(testNetwork), StateUp)
+		}
+	})
+}
+
+func TestHealthCheck(t *testing.T) {
+	flaky, up := newRPCServer(t, 1), newRPCServer(t, 2)
+	flaky.setMode(modeDown)
+	cfg := testEthConfig()
+	cfg.EjectionBackoff, cfg.MaxEjectionBackoff = 200*time.Millisecond, 200*time.Millisecond
+	m := newTestManager(t, cfg, flaky, up)
+
+	m.checkHealth()
+	if es := endpointStatus(t, m, testNetwork, flaky.URL); es.Active || es.Failures != 1 {
+		t.Fatalf("endpoint not ejected: %+v", es)
+	}
+	if es := endpointStatus(t, m, testNetwork, up.URL); !es.Active {
+		t.Fatalf("endpoint ejected: %+v", es)
+	}
+
+	// not checked during its backoff
+	flaky.setMode(modeUp)
+	calls := flaky.callCount()
+	m.checkHealth()
+	if flaky.callCount() != calls {
+		t.Errorf("ejected endpoint checked during its backoff")
+	}
+
+	time.Sleep(cfg.EjectionBackoff)
+	m.checkHealth()
+	if es := endpointStatus(t, m, testNetwork, flaky.URL); !es.Active || es.Failures != 0 || es.LastError != "" {
+		t.Errorf("endpoint not reinstated: %+v", es)
+	}
+}
+
+func TestUpdateEndpoints(t *testing.T) {
+	cfg := config.EthConfig{EjectionBackoff: time.Minute, MaxEjectionBackoff: time.Minute}
+	n := &network{}
+	n.setEndpoints([]string{"http://a", "http://b"})
+	a := n.endpoints[0]
+	n.fail(a, context.DeadlineExceeded, cfg)
+
+	added, removed := n.updateEndpoints([]string{"http://b", "http://a", "http://c"})
+	if !reflect.DeepEqual(added, []string{"http://c"}) || len(removed) != 0 {
+		t.Errorf("added %v, removed %v", added, removed)
+	}
+	if len(n.endpoints) != 3 || n.endpoints[1] != a || a.failures != 1 || a.active(time.Now()) {
+		t.Errorf("ejection of a remaining endpoint not kept: %+v", n.status())
+	}
+	if n.changes != 1 {
+		t.Errorf("%d changes, want 1", n.changes)
+	}
+
+	if added, removed = n.updateEndpoints([]string{"http://b", "http://a", "http://c"}); len(added) != 0 ||
+		len(removed) != 0 || n.changes != 1 {
+		t.Errorf("unchanged endpoints: added %v, removed %v, %d changes", added, removed, n.changes)
+	}
+
+	added, removed = n.updateEndpoints([]string{"http://c"})
+	if len(added) != 0 || len(removed) != 2 || len(n.endpoints) != 1 || n.endpoints[0].url != "http://c" {
+		t.Errorf("added %v, removed %v: %+v", added, removed, n.status())
+	}
+	if n.changes != 2 || n.status().LastResolved == nil {
+		t.Errorf("status after changes: %+v", n.status())
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	a, b := newRPCServer(t, 1), newRPCServer(t, 2)
+
+	var mutex sync.Mutex
+	fabricConfig := map[string]interface{}{}
+	setConfig := func(js map[string]interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		fabricConfig = js
+	}
+	setEthUrls := func(urls ...string) {
+		setConfig(map[string]interface{}{
+			"network": map[string]interface{}{"services": map[string]interface{}{"ethereum_api": urls}},
+		})
+	}
+	configServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		_ = json.NewEncoder(w).Encode(fabricConfig)
+	}))
+	defer configServer.Close()
+
+	m := NewClientManager(testEthConfig(), map[string]config.NetworkConfig{testNetwork: {ConfigUrl: configServer.URL}})
+	defer m.Close()
+	urls := func() (urls []string) {
+		for _, es := range m.Status()[testNetwork].Endpoints {
+			urls = append(urls, es.Url)
+		}
+		return
+	}
+
+	// unresolved until the config lists endpoints
+	m.Start()
+	waitFor(t, "resolve error", func() bool { return m.Status()[testNetwork].LastError != "" })
+	if m.State(testNetwork) != StateResolving {
+		t.Errorf("state %s, want %s", m.State(testNetwork), StateResolving)
+	}
+	if _, err := blockNumber(m, testNetwork); err == nil {
+		t.Error("call on an unresolved network")
+	}
+
+	setEthUrls(a.URL)
+	waitFor(t, "endpoints resolved", func() bool { return reflect.DeepEqual(urls(), []string{a.URL}) })
+	if number, err := blockNumber(m, testNetwork); err != nil || number != 1 {
+		t.Errorf("endpoint %d, %v", number, err)
+	}
+
+	setEthUrls(b.URL)
+	waitFor(t, "endpoints refreshed", func() bool { return reflect.DeepEqual(urls(), []string{b.URL}) })
+	if number, err := blockNumber(m, testNetwork); err != nil || number != 2 {
+		t.Errorf("endpoint %d, %v", number, err)
+	}
+	if changes := m.Status()[testNetwork].EndpointChanges; changes != 2 {
+		t.Errorf("%d endpoint changes, want 2", changes)
+	}
+
+	// a malformed config keeps the current endpoints
+	setConfig(map[string]interface{}{"network": map[string]interface{}{"services": "none"}})
+	waitFor(t, "refresh error", func() bool { return m.Status()[testNetwork].LastError != "" })
+	if got := urls(); !reflect.DeepEqual(got, []string{b.URL}) {
+		t.Errorf("endpoints %v after a failed refresh, want %v", got, []string{b.URL})
+	}
+	if number, err := blockNumber(m, testNetwork); err != nil || number != 2 {
+		t.Errorf("endpoint %d, %v", number, err)
+	}
+}
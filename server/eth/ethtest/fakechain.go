@@ -0,0 +1,299 @@
+// Package ethtest provides an in-process fake chain, to run the daemon end to end without any network.
+package ethtest
+
+import (
+	"context"
+	"fulfillmentd/server/eth"
+	"github.com/eluv-io/contracts/contracts-go/tradable"
+	"github.com/eluv-io/errors-go"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// callTimeout is the timeout of the context passed to a CallFunc
+const callTimeout = 5 * time.Second
+
+// FakeChain is a chain of ElvTradable contracts held in memory. Transactions added to it carry real Redeem event logs,
+// and contract calls are answered from its state, so it stands in for the eth backend of every network in tests.
+type FakeChain struct {
+	mutex       sync.Mutex
+	networks    []string
+	down        map[string]bool
+	head        uint64
+	nextTx      int64
+	txs         map[common.Hash]*Tx
+	owners      map[common.Address]common.Address                // contract owners
+	tokenOwners map[common.Address]map[string]common.Address     // token owners by contract and token id
+	redeemed    map[common.Address]map[string]map[uint8]struct{} // redeemed offers by contract and token id
+	abi         *abi.ABI
+}
+
+// Redeem is a Redeem event of an ElvTradable contract.
+type Redeem struct {
+	Contract string
+	Redeemer string
+	TokenId  int64
+	OfferId  uint8
+}
+
+// Tx is a transaction on the fake chain.
+type Tx struct {
+	Hash      string      // set by AddTx
+	Block     uint64      // block the transaction is mined in; set by AddTx
+	Redeems   []Redeem    // emitted as Redeem event logs, in order
+	OtherLogs []types.Log // emitted before the Redeem events
+	Pending   bool        // not mined yet
+	Reverted  bool        // mined, with a failed status and no logs
+}
+
+// NewFakeChain returns an empty chain serving `networks`.
+func NewFakeChain(networks ...string) *FakeChain {
+	parsed, err := tradable.ElvTradableMetaData.GetAbi()
+	if err != nil {
+		panic(err)
+	}
+	return &FakeChain{
+		networks:    networks,
+		down:        make(map[string]bool),
+		txs:         make(map[common.Hash]*Tx),
+		owners:      make(map[common.Address]common.Address),
+		tokenOwners: make(map[common.Address]map[string]common.Address),
+		redeemed:    make(map[common.Address]map[string]map[uint8]struct{}),
+		abi:         parsed,
+	}
+}
+
+// AddTx adds `tx` to the chain, mined in a new block unless pending, and returns its hash. The Redeem events of a
+// successful tx mark their offers redeemed; a token redeemed without a known owner is owned by its redeemer.
+func (c *FakeChain) AddTx(tx Tx) (hash string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.nextTx++
+	h := common.BigToHash(big.NewInt(c.nextTx))
+	tx.Hash = h.Hex()
+	if !tx.Pending {
+		c.head++
+		tx.Block = c.head
+	}
+	c.txs[h] = &tx
+
+	if !tx.Pending && !tx.Reverted {
+		for _, r := range tx.Redeems {
+			contract, tokenId := common.HexToAddress(r.Contract), big.NewInt(r.TokenId).String()
+			if _, ok := c.tokenOwners[contract][tokenId]; !ok {
+				c.setTokenOwner(contract, tokenId, common.HexToAddress(r.Redeemer))
+			}
+			if c.redeemed[contract] == nil {
+				c.redeemed[contract] = make(map[string]map[uint8]struct{})
+			}
+			if c.redeemed[contract][tokenId] == nil {
+				c.redeemed[contract][tokenId] = make(map[uint8]struct{})
+			}
+			c.redeemed[contract][tokenId][r.OfferId] = struct{}{}
+		}
+	}
+
+	return tx.Hash
+}
+
+// Mine adds `blocks` empty blocks to the chain.
+func (c *FakeChain) Mine(blocks uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.head += blocks
+}
+
+// SetOwner sets the owner of `contract`.
+func (c *FakeChain) SetOwner(contract, owner string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.owners[common.HexToAddress(contract)] = common.HexToAddress(owner)
+}
+
+// SetTokenOwner sets the owner of token `tokenId` of `contract`, e.g. after a transfer.
+func (c *FakeChain) SetTokenOwner(contract string, tokenId int64, owner string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.setTokenOwner(common.HexToAddress(contract), big.NewInt(tokenId).String(), common.HexToAddress(owner))
+}
+
+// SetDown makes calls on `network` fail as if all its endpoints were unreachable, or not if `down` is false.
+func (c *FakeChain) SetDown(network string, down bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.down[network] = down
+}
+
+func (c *FakeChain) setTokenOwner(contract common.Address, tokenId string, owner common.Address) {
+	if c.tokenOwners[contract] == nil {
+		c.tokenOwners[contract] = make(map[string]common.Address)
+	}
+	c.tokenOwners[contract][tokenId] = owner
+}
+
+// Networks, State, Status, Do and Close implement eth.Backends.
+
+func (c *FakeChain) Networks() []string {
+	return c.networks
+}
+
+func (c *FakeChain) State(network string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.down[network] {
+		return eth.StateDown
+	}
+	return eth.StateUp
+}
+
+func (c *FakeChain) Status() map[string]eth.NetworkStatus {
+	status := make(map[string]eth.NetworkStatus, len(c.networks))
+	for _, net := range c.networks {
+		status[net] = eth.NetworkStatus{State: c.State(net), Endpoints: []eth.EndpointStatus{}}
+	}
+	return status
+}
+
+func (c *FakeChain) Do(network string, fn eth.CallFunc) error {
+	known := false
+	for _, net := range c.networks {
+		known = known || net == network
+	}
+	if !known {
+		return errors.NoTrace("unknown network", errors.K.Invalid, "network", network)
+	}
+	if c.State(network) == eth.StateDown {
+		return errors.NoTrace("no eth endpoint available", errors.K.Unavailable, "network", network)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	return fn(ctx, c)
+}
+
+func (c *FakeChain) Close() {}
+
+// TransactionByHash, TransactionReceipt, BlockNumber, CodeAt and CallContract implement eth.Backend.
+
+func (c *FakeChain) TransactionByHash(_ context.Context, hash common.Hash) (*types.Transaction, bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	tx, ok := c.txs[hash]
+	if !ok {
+		return nil, false, ethereum.NotFound
+	}
+	return types.NewTx(&types.LegacyTx{}), tx.Pending, nil
+}
+
+func (c *FakeChain) TransactionReceipt(_ context.Context, hash common.Hash) (*types.Receipt, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	tx, ok := c.txs[hash]
+	if !ok || tx.Pending {
+		return nil, ethereum.NotFound
+	}
+
+	receipt := &types.Receipt{
+		Status:      types.ReceiptStatusSuccessful,
+		TxHash:      hash,
+		BlockNumber: new(big.Int).SetUint64(tx.Block),
+		Logs:        []*types.Log{},
+	}
+	if tx.Reverted {
+		receipt.Status = types.ReceiptStatusFailed
+		return receipt, nil
+	}
+
+	for i := range tx.OtherLogs {
+		l := tx.OtherLogs[i]
+		receipt.Logs = append(receipt.Logs, &l)
+	}
+	redeemEvent := c.abi.Events["Redeem"]
+	for _, r := range tx.Redeems {
+		data, err := redeemEvent.Inputs.NonIndexed().Pack(common.HexToAddress(r.Redeemer), big.NewInt(r.TokenId), r.OfferId)
+		if err != nil {
+			return nil, err
+		}
+		receipt.Logs = append(receipt.Logs, &types.Log{
+			Address: common.HexToAddress(r.Contract),
+			Topics:  []common.Hash{redeemEvent.ID},
+			Data:    data,
+		})
+	}
+	for i, l := range receipt.Logs {
+		l.TxHash, l.BlockNumber, l.Index = hash, tx.Block, uint(i)
+	}
+
+	return receipt, nil
+}
+
+func (c *FakeChain) BlockNumber(context.Context) (uint64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.head, nil
+}
+
+func (c *FakeChain) CodeAt(_ context.Context, contract common.Address, _ *big.Int) ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, hasOwner := c.owners[contract]
+	_, hasTokens := c.tokenOwners[contract]
+	if hasOwner || hasTokens {
+		return []byte{0x1}, nil
+	}
+	return nil, nil
+}
+
+func (c *FakeChain) CallContract(_ context.Context, call ethereum.CallMsg, _ *big.Int) ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if call.To == nil || len(call.Data) < 4 {
+		return nil, errors.NoTrace("invalid call", errors.K.Invalid)
+	}
+	method, err := c.abi.MethodById(call.Data[:4])
+	if err != nil {
+		return nil, err
+	}
+	args, err := method.Inputs.Unpack(call.Data[4:])
+	if err != nil {
+		return nil, err
+	}
+
+	contract := *call.To
+	switch method.Name {
+	case "owner":
+		owner, ok := c.owners[contract]
+		if !ok {
+			return nil, nil
+		}
+		return method.Outputs.Pack(owner)
+	case "ownerOf":
+		owner, ok := c.tokenOwners[contract][args[0].(*big.Int).String()]
+		if !ok {
+			return nil, errors.NoTrace("execution reverted: ERC721: owner query for nonexistent token",
+				errors.K.Invalid)
+		}
+		return method.Outputs.Pack(owner)
+	case "isOfferRedeemed":
+		_, ok := c.redeemed[contract][args[0].(*big.Int).String()][args[1].(uint8)]
+		return method.Outputs.Pack(ok)
+	}
+
+	return nil, errors.NoTrace("call not supported by fake chain", errors.K.NotImplemented, "method", method.Name)
+}
@@ -0,0 +1,67 @@
+package eth
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/eluv-io/errors-go"
+	"io/ioutil"
+	"net/http"
+)
+
+// fetchEthUrls loads the fabric config url js data and then pulls out all eth endpoints in it.
+func fetchEthUrls(ctx context.Context, configUrl string) (ethUrls []string, err error) {
+	var req *http.Request
+	var resp *http.Response
+	var body []byte
+	var js map[string]interface{}
+
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, configUrl, nil); err != nil {
+		return
+	}
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = errors.NoTrace("cannot get config", errors.K.Unavailable, "status", resp.Status)
+		return
+	}
+
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(body, &js); err != nil {
+		return
+	}
+
+	network, ok := js["network"].(map[string]interface{})
+	if !ok {
+		err = errors.NoTrace("no network in config")
+		return
+	}
+
+	services, ok := network["services"].(map[string]interface{})
+	if !ok {
+		err = errors.NoTrace("no services in config")
+		return
+	}
+
+	ethApi, ok := services["ethereum_api"].([]interface{})
+	if !ok {
+		err = errors.NoTrace("no ethereum_api in config")
+		return
+	}
+
+	for _, u := range ethApi {
+		if ethUrl, ok := u.(string); ok && ethUrl != "" {
+			ethUrls = append(ethUrls, ethUrl)
+		}
+	}
+	if len(ethUrls) == 0 {
+		err = errors.NoTrace("no ethereum_api in config")
+		return
+	}
+
+	return
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"fulfillmentd/redeemservice/db"
+)
+
+// MigrateDb applies pending schema migrations if db.run_migrations is set, and refuses a database schema that is
+// newer than this binary knows.
+func (s *Server) MigrateDb() (err error) {
+	if s.ConnectionManager == nil {
+		return
+	}
+
+	var m *db.Migrator
+	if m, err = db.NewMigrator(s.ConnectionManager); err != nil {
+		return
+	}
+
+	if s.Cfg.DbConfig.RunMigrations {
+		var applied []db.Migration
+		if applied, err = m.Up(); err != nil {
+			log.Error("error applying migrations", err)
+			return
+		}
+		log.Info("applied migrations", "migrations", applied)
+	}
+
+	return m.CheckVersion()
+}
@@ -1,16 +1,59 @@
 package server
 
 import (
+	"fmt"
+	"fulfillmentd/redeemservice/alert"
 	"fulfillmentd/redeemservice/db"
+	"fulfillmentd/redeemservice/fulfiller"
+	"fulfillmentd/server/config"
+	"fulfillmentd/utils"
+	"github.com/eluv-io/errors-go"
+	"io"
+	"strings"
+	"time"
 )
 
 type FulfillmentService struct {
-	db *db.FulfillmentPersistence
+	admin      config.AdminConfig
+	policy     config.PolicyConfig
+	db         *db.FulfillmentPersistence
+	fulfillers *fulfiller.Registry
+	codePool   fulfiller.Fulfiller
+	alerts     *alert.Alerter // nil without alerts.webhook_url
 }
 
-func NewFulfillmentService(s *Server) *FulfillmentService {
-	return &FulfillmentService{
-		db: db.NewFulfillmentPersistence(s.ConnectionManager, s.Cfg.EthUrlsByNetwork),
+func NewFulfillmentService(s *Server) (fs *FulfillmentService, err error) {
+	var resolver db.RedemptionResolver = db.NewEthResolver(s.Chain, s.Cfg.Networks)
+	if s.Cfg.Simulation.Enabled {
+		if resolver, err = db.LoadSimulation(s.Cfg.Simulation.Fixtures); err != nil {
+			return
+		}
+	}
+
+	fp := db.NewFulfillmentPersistence(newStore(s), s.Chain, s.Cfg.Networks, resolver)
+	fs = &FulfillmentService{
+		admin:      s.Cfg.AdminConfig,
+		policy:     s.Cfg.Policy,
+		db:         fp,
+		fulfillers: fulfiller.Default(),
+		codePool:   fulfiller.NewCodePool(fp),
+	}
+
+	if s.Cfg.Alerts.WebhookUrl != "" {
+		if fs.alerts, err = alert.NewAlerter(s.Cfg.Alerts, fp); err != nil {
+			return
+		}
+	} else if len(s.Cfg.Alerts.Thresholds) > 0 {
+		log.Warn("ignoring alert thresholds without alerts.webhook_url")
+	}
+
+	return
+}
+
+// Close waits for the low-inventory alerts in progress.
+func (fs *FulfillmentService) Close() {
+	if fs.alerts != nil {
+		fs.alerts.Close()
 	}
 }
 
@@ -18,14 +61,151 @@ func (fs *FulfillmentService) AvailableNetworks() (nets []string) {
 	return fs.db.AvailableNetworks()
 }
 
-func (fs *FulfillmentService) SetupFulfillment(setup db.SetupData) (err error) {
-	return fs.db.SetupFulfillment(setup)
+// NetworkState returns the state of the eth endpoints of `network`, e.g. eth.StateUp.
+func (fs *FulfillmentService) NetworkState(network string) string {
+	return fs.db.NetworkState(network)
+}
+
+// SetupFulfillment adds the codes of `setup` to the pool; see db.FulfillmentPersistence.SetupFulfillment.
+func (fs *FulfillmentService) SetupFulfillment(setup db.SetupData) (result db.SetupResult, err error) {
+	if result, err = fs.db.SetupFulfillment(setup); err == nil && result.Loaded > 0 && fs.alerts != nil {
+		fs.alerts.Restocked(strings.ToLower(setup.ContractAddress), setup.OfferId)
+	}
+	return
+}
+
+// ImportCodes streams the rows of `r` into the pool of the contract and offer; see db.FulfillmentPersistence.ImportCodes.
+func (fs *FulfillmentService) ImportCodes(contractAddr, offerId, defaultUrl, format string,
+	r io.Reader) (summary db.ImportSummary, err error) {
+	summary, err = fs.db.ImportCodes(contractAddr, offerId, defaultUrl, format, r)
+	if summary.Inserted > 0 && fs.alerts != nil {
+		fs.alerts.Restocked(strings.ToLower(contractAddr), offerId)
+	}
+	return
+}
+
+func (fs *FulfillmentService) PutOffer(offer db.Offer) (stored db.Offer, err error) {
+	return fs.db.PutOffer(offer)
+}
+
+func (fs *FulfillmentService) GetOffer(contractAddr, offerId string) (offer db.Offer, err error) {
+	return fs.db.GetOffer(contractAddr, offerId)
+}
+
+func (fs *FulfillmentService) ListOffers(contractAddr string) (offers []db.Offer, err error) {
+	return fs.db.ListOffers(contractAddr)
+}
+
+// SetOfferStatus pauses, resumes or retires the registered offer, with the status db.OfferPaused, db.OfferActive or
+// db.OfferRetired.
+func (fs *FulfillmentService) SetOfferStatus(contractAddr, offerId, status string) (offer db.Offer, err error) {
+	return fs.db.SetOfferStatus(contractAddr, offerId, status)
+}
+
+// GetStats returns the inventory of the offer of the contract, or of each of its offers with codes if `offerId` is
+// empty.
+func (fs *FulfillmentService) GetStats(contractAddr, offerId string) (stats []db.OfferStats, err error) {
+	return fs.db.GetStats(contractAddr, offerId, time.Now())
+}
+
+func (fs *FulfillmentService) GetUnclaimed(contractAddr, redeemableId string) (unclaimed []string, err error) {
+	return fs.db.GetUnclaimed(contractAddr, redeemableId)
 }
 
-func (fs *FulfillmentService) FulfillRedeemableOffer(request db.FulfillmentRequest) (fd db.FulfillmentResponse, err error) {
-	return fs.db.FulfillRedeemableOffer(request)
+// FulfillmentResult is the outcome of fulfilling one redemption in a transaction.
+type FulfillmentResult struct {
+	Transaction      db.RedemptionTransaction
+	Fulfillment      db.FulfillmentResponse
+	AlreadyFulfilled bool  // Fulfillment is from an earlier request
+	Err              error // the redemption was not fulfilled
+}
+
+// FulfillRedeemableOffers resolves the redemption transaction in `request`, then fulfills each offer redeemed in it
+// with the Fulfiller for its contract and offer. Offers fail individually, e.g. when out of codes or redeemed by
+// another user; err is only returned if the transaction cannot be resolved.
+func (fs *FulfillmentService) FulfillRedeemableOffers(request db.FulfillmentRequest) (results []FulfillmentResult, err error) {
+	var txs []db.RedemptionTransaction
+	if txs, err = fs.db.ResolveTransaction(request); err != nil {
+		log.Warn("error resolving tx", "error", err)
+		err = errors.NoTrace("error resolving tx", errors.K.Invalid, err, "request", request)
+		return
+	}
+	log.Debug("FulfillRedeemableOffers", "request", fmt.Sprintf("%+v", request), "txs", fmt.Sprintf("%+v", txs))
+
+	results = make([]FulfillmentResult, 0, len(txs))
+	for _, tx := range txs {
+		results = append(results, fs.fulfill(request, tx))
+	}
+
+	return
+}
+
+// fulfill verifies the redemption `tx` was made by the requesting user, that its offer is registered and claimable,
+// and with the verify_ownership policy that the user still owns the token on chain, then fulfills it, or returns the
+// earlier fulfillment if the token was already fulfilled. An earlier fulfillment is also returned for an offer that
+// was paused, retired or expired since, or that is not registered.
+func (fs *FulfillmentService) fulfill(request db.FulfillmentRequest, tx db.RedemptionTransaction) (res FulfillmentResult) {
+	res.Transaction = tx
+
+	if request.UserAddress != tx.RedeemerAddress {
+		res.Err = errors.NoTrace("mismatched user address", errors.K.Invalid, "request", request, "tx", tx)
+		return
+	}
+
+	offerErr := fs.db.CheckOffer(request.Network, tx, time.Now())
+	var unavailable *db.OfferUnavailableError
+	if offerErr != nil && !(errors.As(offerErr, &unavailable) && unavailable.AllowsEarlierFulfillment()) {
+		res.Err = offerErr
+		return
+	}
+
+	offerId, tokenId := tx.OfferAndTokenIds()
+	if fs.verifiesOwnership(tx.ContractAddress, offerId) {
+		if res.Err = fs.db.VerifyOwnership(request.Network, tx); res.Err != nil {
+			return
+		}
+	}
+
+	f := fs.fulfillerFor(tx.ContractAddress, offerId)
+	if offerErr == nil {
+		if res.Fulfillment, res.Err = f.FulfillRedeemableOffer(tx); res.Err == nil {
+			if fs.alerts != nil {
+				fs.alerts.Claimed(tx.ContractAddress, offerId)
+			}
+			return
+		}
+	}
+
+	redeemed, getErr := f.GetRedeemedOffer(tx.ContractAddress, offerId, tokenId)
+	log.Trace("GetRedeemedOffer", "redeemed", redeemed, "getErr", getErr)
+	if getErr == nil && redeemed.Claimed {
+		res.Fulfillment, res.AlreadyFulfilled, res.Err = redeemed, true, nil
+	} else if offerErr != nil {
+		res.Err = offerErr
+	}
+
+	return
+}
+
+// newStore returns the code pool storage for the configured db.store
+func newStore(s *Server) db.Store {
+	if s.ConnectionManager == nil {
+		return db.NewMemStore()
+	}
+	return db.NewPgStore(s.ConnectionManager)
+}
+
+// fulfillerFor returns the registered Fulfiller for the contract and offer, or the built-in code pool.
+func (fs *FulfillmentService) fulfillerFor(contractAddr, offerId string) fulfiller.Fulfiller {
+	if f, ok := fs.fulfillers.Lookup(contractAddr, offerId); ok {
+		return f
+	}
+	return fs.codePool
 }
 
-func (fs *FulfillmentService) GetRedeemableOffer(contractAddr, redeemableId, tokenId string) (fd db.FulfillmentResponse, err error) {
-	return fs.db.GetRedeemedOffer(contractAddr, redeemableId, tokenId)
+// verifiesOwnership tells whether the verify_ownership policy applies to the contract and offer.
+func (fs *FulfillmentService) verifiesOwnership(contractAddr, offerId string) bool {
+	contractAddr = strings.ToLower(contractAddr)
+	return utils.ArrayContains(fs.policy.VerifyOwnership, contractAddr+"/"+offerId) ||
+		utils.ArrayContains(fs.policy.VerifyOwnership, contractAddr+"/"+fulfiller.AnyOffer)
 }